@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessRecord is one line in the access log, tunnels are logged when they close
+type accessRecord struct {
+	Time           time.Time `json:"time"`
+	Client         string    `json:"client"`
+	User           string    `json:"user"`
+	Method         string    `json:"method"`
+	Target         string    `json:"target"`
+	Proto          string    `json:"proto"`
+	Route          string    `json:"route,omitempty"`
+	Status         int       `json:"status"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+	DurationMs     float64   `json:"duration_ms"`
+	Cache          string    `json:"cache,omitempty"`
+	CloseReason    string    `json:"close_reason,omitempty"`
+	Referer        string    `json:"referer,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	// tunnel is set when the record is written by the tunnel instead of the handler
+	tunnel bool
+}
+
+func NewAccessRecord(req *http.Request) *accessRecord {
+	target := req.URL.String()
+	if req.Method == http.MethodConnect {
+		target = req.Host
+	}
+	return &accessRecord{
+		Time:      time.Now(),
+		Client:    ClientIP(req),
+		User:      "-",
+		Method:    req.Method,
+		Target:    target,
+		Proto:     req.Proto,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+}
+
+// CacheResult records whether the PAC lookup came from the cache
+func (r *accessRecord) CacheResult(cached bool) {
+	if cached {
+		r.Cache = "hit"
+	} else {
+		r.Cache = "miss"
+	}
+}
+
+// loggingWriter remembers the status and the number of bytes sent to the client
+type loggingWriter struct {
+	http.ResponseWriter
+	status   int
+	written  int64
+	hijacked bool
+}
+
+func (l *loggingWriter) WriteHeader(status int) {
+	if l.status == 0 {
+		l.status = status
+	}
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *loggingWriter) Write(p []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	n, err := l.ResponseWriter.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+func (l *loggingWriter) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (l *loggingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	l.hijacked = true
+	return hijacker.Hijack()
+}
+
+// countingBody counts the bytes of the request body read from the client
+type countingBody struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+// CountBody makes reads of the request body add to the record
+func (r *accessRecord) CountBody(req *http.Request) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &countingBody{req.Body, &r.BytesIn}
+	}
+}
+
+// accessLog writes one line per request or tunnel as JSON or in the combined log format
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// NewAccessLog opens path for appending, "-" is stdout
+func NewAccessLog(path string, format string) (*accessLog, error) {
+	if format != "json" && format != "combined" {
+		return nil, errors.New(fmt.Sprintf("unknown access log format %v", format))
+	}
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &accessLog{w: w, format: format}, nil
+}
+
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// Line formats a record
+func (a *accessLog) Line(r *accessRecord) string {
+	if a.format == "combined" {
+		// the route, duration and cache result go after the usual fields
+		return fmt.Sprintf(`%v - %v [%v] "%v %v %v" %v %v "%v" "%v" "%v" %.3f %v`,
+			clfField(r.Client), clfField(r.User), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, r.Target, r.Proto, r.Status, r.BytesOut,
+			clfField(r.Referer), clfField(r.UserAgent), clfField(r.Route), r.DurationMs, clfField(r.Cache))
+	}
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// Finish writes the record when the handler returns, tunnels are left to
+// write their own record when they close
+func (a *accessLog) Finish(r *accessRecord, l *loggingWriter) {
+	if r.tunnel {
+		return
+	}
+	a.Complete(r, l)
+}
+
+// Complete fills in the record from what was sent to the client and writes it
+func (a *accessLog) Complete(r *accessRecord, l *loggingWriter) {
+	if r.Status == 0 {
+		r.Status = l.status
+		if r.Status == 0 && l.hijacked {
+			r.Status = http.StatusOK
+		}
+	}
+	r.BytesOut += l.written
+	a.Write(r)
+}
+
+// Write logs the record, a nil accessLog does nothing
+func (a *accessLog) Write(r *accessRecord) {
+	if a == nil {
+		return
+	}
+	r.BytesIn = atomic.LoadInt64(&r.BytesIn)
+	r.DurationMs = float64(time.Since(r.Time).Microseconds()) / 1000
+	line := a.Line(r)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := io.WriteString(a.w, strings.TrimSpace(line)+"\n"); err != nil {
+		log.Printf(`accessLog: error writing record: %v`, err)
+	}
+}
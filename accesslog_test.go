@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForRecords waits until the log has n lines and returns them
+func waitForRecords(t *testing.T, a *accessLog, buf *bytes.Buffer, n int) []accessRecord {
+	for i := 0; i < 200; i++ {
+		a.mu.Lock()
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		a.mu.Unlock()
+		if len(lines) >= n && lines[0] != "" {
+			var records []accessRecord
+			for _, line := range lines {
+				var r accessRecord
+				if err := json.Unmarshal([]byte(line), &r); err != nil {
+					t.Fatalf("Error parsing %v: %v", line, err)
+				}
+				records = append(records, r)
+			}
+			return records
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %v access log records, got %v", n, buf.String())
+	return nil
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	a, err := NewAccessLog("-", "combined")
+	if err != nil {
+		t.Fatalf("Error creating access log: %v", err)
+	}
+	r := &accessRecord{
+		Time:       time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		Client:     "10.0.0.1",
+		User:       "me",
+		Method:     "GET",
+		Target:     "http://example.com/",
+		Proto:      "HTTP/1.1",
+		Route:      "PROXY proxy.corp:8080",
+		Status:     200,
+		BytesOut:   512,
+		DurationMs: 12.5,
+		Cache:      "hit",
+		UserAgent:  "curl/7.68.0",
+	}
+	want := `10.0.0.1 - me [04/Mar/2021:05:06:07 +0000] "GET http://example.com/ HTTP/1.1" 200 512 "-" "curl/7.68.0" "PROXY proxy.corp:8080" 12.500 hit`
+	if got := a.Line(r); got != want {
+		t.Fatalf("Got %v, want %v", got, want)
+	}
+	if _, err := NewAccessLog("-", "xml"); err == nil {
+		t.Fatalf("Expected an error for an unknown format")
+	}
+}
+
+func TestAccessLogRequest(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer target.Close()
+
+	var buf bytes.Buffer
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.accessLog = &accessLog{w: &buf, format: "json"}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(target.URL+"/things", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Error calling Post: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	r := waitForRecords(t, p.accessLog, &buf, 1)[0]
+	if r.Method != "POST" || r.Target != target.URL+"/things" || r.Client != "127.0.0.1" || r.User != "-" {
+		t.Fatalf("Got unexpected record = %+v", r)
+	}
+	if r.Route != "DIRECT" || r.Status != 201 || r.UpstreamStatus != 201 || r.BytesIn != 5 || r.BytesOut != 7 {
+		t.Fatalf("Got unexpected record = %+v", r)
+	}
+}
+
+func TestAccessLogTunnel(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// read the ping and answer it
+		io.ReadFull(conn, make([]byte, 4))
+		conn.Write([]byte("pong!"))
+	}()
+
+	var buf bytes.Buffer
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.accessLog = &accessLog{w: &buf, format: "json"}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to proxy: %v", err)
+	}
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target.Addr(), target.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got %v, %v from CONNECT", resp, err)
+	}
+	conn.Write([]byte("ping"))
+	io.ReadFull(br, make([]byte, 5))
+	conn.Close()
+
+	r := waitForRecords(t, p.accessLog, &buf, 1)[0]
+	if r.Method != "CONNECT" || r.Target != target.Addr().String() || r.Route != "DIRECT" || r.Status != 200 {
+		t.Fatalf("Got unexpected record = %+v", r)
+	}
+	if r.BytesIn != 4 || r.BytesOut != 5 || r.CloseReason != closeEOF {
+		t.Fatalf("Got unexpected record = %+v", r)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+/*
+ * Proxy authentication, the challenge grammar is from RFC 9110 section 11
+ * https://www.rfc-editor.org/rfc/rfc9110#section-11
+ * Basic is RFC 7617 and Digest is RFC 7616, NTLM and Negotiate have their own files
+ */
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// how many times we will answer a 407 during a single request
+const maxAuthAttempts = 3
+
+// schemes we can answer, most preferred first
+var authSchemePreference = []string{"negotiate", "ntlm", "digest", "basic"}
+
+// authChallenge is one challenge from a Proxy-Authenticate header
+// Scheme is lower case, as are the names of the parameters
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+	Token  string
+}
+
+func isTokenChar(c byte) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isToken68Char(c byte) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("-._~+/", c) >= 0
+}
+
+// challengeParser walks a single Proxy-Authenticate header value
+type challengeParser struct {
+	s string
+	i int
+}
+
+func (p *challengeParser) skipSpace() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *challengeParser) atEnd() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *challengeParser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *challengeParser) token() string {
+	start := p.i
+	for p.i < len(p.s) && isTokenChar(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *challengeParser) quoted() string {
+	// skip the opening quote
+	p.i++
+	var sb strings.Builder
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		p.i++
+		if c == '\\' && p.i < len(p.s) {
+			sb.WriteByte(p.s[p.i])
+			p.i++
+			continue
+		}
+		if c == '"' {
+			break
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// token68 tries to read a token68 which must be followed by the end or a comma
+func (p *challengeParser) token68() (string, bool) {
+	start := p.i
+	for p.i < len(p.s) && isToken68Char(p.s[p.i]) {
+		p.i++
+	}
+	for p.i < len(p.s) && p.s[p.i] == '=' {
+		p.i++
+	}
+	end := p.i
+	p.skipSpace()
+	if end > start && (p.atEnd() || p.peek() == ',') {
+		return p.s[start:end], true
+	}
+	p.i = start
+	return "", false
+}
+
+// param tries to read name=value, leaving the position unchanged if there is not one
+func (p *challengeParser) param() (string, string, bool) {
+	start := p.i
+	name := p.token()
+	p.skipSpace()
+	if name == "" || p.peek() != '=' {
+		p.i = start
+		return "", "", false
+	}
+	p.i++
+	p.skipSpace()
+	if p.peek() == '"' {
+		return strings.ToLower(name), p.quoted(), true
+	}
+	return strings.ToLower(name), p.token(), true
+}
+
+func (p *challengeParser) challenges() []authChallenge {
+	result := []authChallenge{}
+	for {
+		// skip empty list elements
+		for p.skipSpace(); p.peek() == ','; p.skipSpace() {
+			p.i++
+		}
+		if p.atEnd() {
+			return result
+		}
+		scheme := p.token()
+		if scheme == "" {
+			log.Printf(`ParseChallenges: unexpected character %q in %v`, p.peek(), p.s)
+			return result
+		}
+		c := authChallenge{Scheme: strings.ToLower(scheme), Params: map[string]string{}}
+		p.skipSpace()
+		if token, ok := p.token68(); ok {
+			c.Token = token
+			result = append(result, c)
+			continue
+		}
+		for {
+			name, value, ok := p.param()
+			if !ok {
+				break
+			}
+			c.Params[name] = value
+			p.skipSpace()
+			if p.peek() != ',' {
+				break
+			}
+			// a comma could be followed by another param or the next challenge
+			save := p.i
+			for p.peek() == ',' || p.peek() == ' ' || p.peek() == '\t' {
+				p.i++
+			}
+			mark := p.i
+			if _, _, ok := p.param(); !ok {
+				p.i = save
+				break
+			}
+			p.i = mark
+		}
+		result = append(result, c)
+	}
+}
+
+// ParseChallenges parses all the challenges in a set of Proxy-Authenticate headers
+func ParseChallenges(headers []string) []authChallenge {
+	result := []authChallenge{}
+	for _, h := range headers {
+		p := &challengeParser{s: h}
+		result = append(result, p.challenges()...)
+	}
+	return result
+}
+
+// upstreamAuth answers authentication challenges from one upstream proxy
+// it remembers the last challenge so later requests can authenticate up front
+type upstreamAuth struct {
+	address string
+	cred    credential
+	mu      sync.Mutex
+	last    *authChallenge
+	nc      int
+}
+
+var (
+	upstreamAuthsMu sync.Mutex
+	upstreamAuths   = map[string]*upstreamAuth{}
+)
+
+// GetUpstreamAuth returns the authenticator for the proxy at address, or nil if
+// we have no credentials for it and Kerberos is not set up
+func GetUpstreamAuth(address string) *upstreamAuth {
+	upstreamAuthsMu.Lock()
+	defer upstreamAuthsMu.Unlock()
+	if a, ok := upstreamAuths[address]; ok {
+		return a
+	}
+	a := &upstreamAuth{address: address}
+	if cred := global_config.CredentialFor(address); cred != nil {
+		a.cred = *cred
+	} else if global_negotiator == nil {
+		return nil
+	}
+	upstreamAuths[address] = a
+	return a
+}
+
+// Choose returns the challenges we are able to answer, most preferred first
+func (a *upstreamAuth) Choose(challenges []authChallenge) []authChallenge {
+	chosen := []authChallenge{}
+	for _, scheme := range authSchemePreference {
+		if scheme == "negotiate" && global_negotiator == nil {
+			continue
+		}
+		if scheme != "negotiate" && a.cred.Username == "" {
+			continue
+		}
+		for _, c := range challenges {
+			if c.Scheme == scheme {
+				chosen = append(chosen, c)
+				break
+			}
+		}
+	}
+	return chosen
+}
+
+// Preemptive returns a Proxy-Authorization value based on the last challenge
+// we saw, or an empty string if we have not been challenged yet
+func (a *upstreamAuth) Preemptive(method string, uri string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last == nil {
+		return ""
+	}
+	authorization, err := a.respond(*a.last, method, uri)
+	if err != nil {
+		return ""
+	}
+	return authorization
+}
+
+// Respond answers a challenge and remembers it for next time
+func (a *upstreamAuth) Respond(c authChallenge, method string, uri string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c.Scheme == "digest" {
+		a.nc = 0
+	}
+	authorization, err := a.respond(c, method, uri)
+	if err == nil {
+		a.last = &c
+	}
+	return authorization, err
+}
+
+// Answer picks the best challenge from a 407 and returns the Proxy-Authorization to send
+// answered says whether we have already sent credentials for this request, if so a
+// fresh challenge means they were rejected
+func (a *upstreamAuth) Answer(challenges []authChallenge, answered bool, method string, uri string) (string, error) {
+	chosen := a.Choose(challenges)
+	if len(chosen) == 0 {
+		return "", errors.New("no supported authentication scheme offered")
+	}
+	var err error
+	for _, c := range chosen {
+		var authorization string
+		authorization, err = a.answer(c, answered, method, uri)
+		if err == nil {
+			return authorization, nil
+		}
+		log.Printf(`Answer: could not answer %v challenge from %v: %v`, c.Scheme, a.address, err)
+	}
+	return "", err
+}
+
+func (a *upstreamAuth) answer(c authChallenge, answered bool, method string, uri string) (string, error) {
+	switch c.Scheme {
+	case "negotiate":
+		// Kerberos is a single round trip so another challenge is a rejection
+		if answered {
+			return "", errors.New("negotiate credentials were rejected")
+		}
+		return NegotiateAuthorization(a.address)
+	case "ntlm":
+		// NTLM is a handshake on one connection, a challenge without a token starts it
+		if c.Token != "" {
+			return NTLMAuthenticate(a.cred, c)
+		}
+		if answered {
+			return "", errors.New("ntlm credentials were rejected")
+		}
+		return NTLMNegotiate(a.cred)
+	}
+	if answered && c.Params["stale"] != "true" {
+		return "", errors.New(fmt.Sprintf("%v credentials were rejected", c.Scheme))
+	}
+	return a.Respond(c, method, uri)
+}
+
+// CheckMutual verifies the proxy on a successful response when we used Negotiate
+func (a *upstreamAuth) CheckMutual(authorization string, resp *http.Response) error {
+	if !strings.HasPrefix(authorization, "Negotiate ") {
+		return nil
+	}
+	requireMutual := global_config.Kerberos != nil && global_config.Kerberos.RequireMutual
+	return VerifyNegotiate(a.address, ParseChallenges(resp.Header.Values("Proxy-Authenticate")), requireMutual)
+}
+
+func (a *upstreamAuth) respond(c authChallenge, method string, uri string) (string, error) {
+	switch c.Scheme {
+	case "basic":
+		return BasicAuthorization(a.cred.Username, a.cred.Password), nil
+	case "digest":
+		a.nc++
+		return DigestAuthorization(c, a.cred.Username, a.cred.Password, method, uri, a.nc, newCnonce())
+	}
+	return "", errors.New(fmt.Sprintf("unsupported authentication scheme %v", c.Scheme))
+}
+
+func BasicAuthorization(username string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// newCnonce is a variable so tests can get repeatable digests
+var newCnonce = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func DigestAuthorization(c authChallenge, username string, password string, method string, uri string, nc int, cnonce string) (string, error) {
+	algorithm := c.Params["algorithm"]
+	var h func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", errors.New(fmt.Sprintf("unsupported digest algorithm %v", algorithm))
+	}
+	hexHash := func(s string) string {
+		hasher := h()
+		hasher.Write([]byte(s))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	realm := c.Params["realm"]
+	nonce := c.Params["nonce"]
+	ha1 := hexHash(username + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = hexHash(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := hexHash(method + ":" + uri)
+
+	qop := ""
+	for _, q := range strings.Split(c.Params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	if c.Params["qop"] != "" && qop == "" {
+		return "", errors.New(fmt.Sprintf("unsupported digest qop %v", c.Params["qop"]))
+	}
+
+	ncString := fmt.Sprintf("%08x", nc)
+	response := ""
+	if qop == "" {
+		response = hexHash(ha1 + ":" + nonce + ":" + ha2)
+	} else {
+		response = hexHash(ha1 + ":" + nonce + ":" + ncString + ":" + cnonce + ":" + qop + ":" + ha2)
+	}
+
+	parts := []string{
+		fmt.Sprintf(`username="%s"`, username),
+		fmt.Sprintf(`realm="%s"`, realm),
+		fmt.Sprintf(`nonce="%s"`, nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if algorithm != "" {
+		parts = append(parts, fmt.Sprintf(`algorithm=%s`, algorithm))
+	}
+	if qop != "" {
+		parts = append(parts, fmt.Sprintf(`qop=%s`, qop), fmt.Sprintf(`nc=%s`, ncString), fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	if opaque, ok := c.Params["opaque"]; ok {
+		parts = append(parts, fmt.Sprintf(`opaque="%s"`, opaque))
+	}
+	return "Digest " + strings.Join(parts, ", "), nil
+}
+
+// rewindBody copies a request which has already been sent with a fresh body so
+// it can be sent again, a body can only be sent again if GetBody is set
+func rewindBody(req *http.Request) (*http.Request, error) {
+	req = req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New(fmt.Sprintf("the body of %v %v was not kept so cannot be sent again to authenticate with the proxy", req.Method, req.URL))
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = body
+	return req, nil
+}
+
+// proxyAuthTransport retries plain HTTP requests which get a 407 from the upstream proxy
+type proxyAuthTransport struct {
+	transport *http.Transport
+	route     route
+	auth      *upstreamAuth
+	dial      func(ctx context.Context) (net.Conn, error)
+}
+
+func (t *proxyAuthTransport) CloseIdleConnections() {
+	t.transport.CloseIdleConnections()
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	uri := req.URL.String()
+	answered := false
+	if authorization := t.auth.Preemptive(req.Method, uri); authorization != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.transport.RoundTrip(req)
+		if err == nil && resp.StatusCode != http.StatusProxyAuthRequired {
+			if err := t.auth.CheckMutual(req.Header.Get("Proxy-Authorization"), resp); err != nil {
+				log.Printf(`proxyAuthTransport: mutual authentication with %v failed: %v`, t.route, err)
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || attempt >= maxAuthAttempts {
+			return resp, err
+		}
+		challenges := ParseChallenges(resp.Header.Values("Proxy-Authenticate"))
+		if chosen := t.auth.Choose(challenges); len(chosen) > 0 && chosen[0].Scheme == "ntlm" && !answered {
+			// NTLM needs its own connection for the whole handshake
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			log.Printf(`proxyAuthTransport: starting NTLM handshake with %v for %v`, t.route, uri)
+			return roundTripNTLM(t.route, t.auth, req, t.dial)
+		}
+		authorization, err := t.auth.Answer(challenges, answered, req.Method, uri)
+		if err != nil {
+			log.Printf(`proxyAuthTransport: giving up on authentication for %v: %v`, uri, err)
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		log.Printf(`proxyAuthTransport: answering challenge for %v`, uri)
+		req, err = rewindBody(req)
+		if err != nil {
+			log.Printf(`proxyAuthTransport: %v`, err)
+			return nil, err
+		}
+		req.Header.Set("Proxy-Authorization", authorization)
+		answered = true
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseChallengesMultiple(t *testing.T) {
+	challenges := ParseChallenges([]string{
+		`Basic realm="corp", Digest realm="corp proxy", nonce="abc,def", qop="auth,auth-int", algorithm=MD5`,
+		`NTLM`,
+		`Negotiate YIIBhgYGKwYBBQUCoIIBejCCAXagMDAuBgkqhkiC9xIBAgIGCSqGSIb3EgECAgYKKwYBBAGCNwICHgYKKwYBBAGCNwICCg==`,
+	})
+	if len(challenges) != 4 {
+		t.Fatalf("Got %v challenges, expected 4: %v", len(challenges), challenges)
+	}
+	if challenges[0].Scheme != "basic" || challenges[0].Params["realm"] != "corp" {
+		t.Fatalf("Got unexpected first challenge = %v", challenges[0])
+	}
+	digest := challenges[1]
+	if digest.Scheme != "digest" || digest.Params["nonce"] != "abc,def" || digest.Params["qop"] != "auth,auth-int" || digest.Params["algorithm"] != "MD5" {
+		t.Fatalf("Got unexpected digest challenge = %v", digest)
+	}
+	if challenges[2].Scheme != "ntlm" || challenges[2].Token != "" {
+		t.Fatalf("Got unexpected NTLM challenge = %v", challenges[2])
+	}
+	if challenges[3].Scheme != "negotiate" || !strings.HasSuffix(challenges[3].Token, "Cg==") {
+		t.Fatalf("Got unexpected negotiate challenge = %v", challenges[3])
+	}
+}
+
+func TestChooseChallengePrefersDigest(t *testing.T) {
+	a := &upstreamAuth{cred: credential{Username: "user"}}
+	chosen := a.Choose(ParseChallenges([]string{`Basic realm="a"`, `Digest realm="b", nonce="c"`}))
+	if len(chosen) != 2 || chosen[0].Scheme != "digest" {
+		t.Fatalf("Expected digest to be chosen, got %v", chosen)
+	}
+}
+
+func TestChooseChallengeSkipsNegotiateWithoutKerberos(t *testing.T) {
+	a := &upstreamAuth{cred: credential{Username: "user"}}
+	chosen := a.Choose(ParseChallenges([]string{`Negotiate`, `Basic realm="a"`}))
+	if len(chosen) != 1 || chosen[0].Scheme != "basic" {
+		t.Fatalf("Expected only basic to be chosen, got %v", chosen)
+	}
+}
+
+func TestDigestAuthorizationRFC2617(t *testing.T) {
+	// this is the example from section 3.5 of RFC 2617
+	c := ParseChallenges([]string{`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`})[0]
+	authorization, err := DigestAuthorization(c, "Mufasa", "Circle Of Life", "GET", "/dir/index.html", 1, "0a4f113b")
+	if err != nil {
+		t.Fatalf("Error calling DigestAuthorization: %v", err)
+	}
+	if !strings.Contains(authorization, `response="6629fae49393a05397450978507c4ef1"`) {
+		t.Fatalf("Got unexpected digest = %v", authorization)
+	}
+	if !strings.Contains(authorization, `nc=00000001`) || !strings.Contains(authorization, `opaque="5ccc069c403ebaf9f0171e9517f40e41"`) {
+		t.Fatalf("Digest is missing fields = %v", authorization)
+	}
+}
+
+func TestBasicAuthorization(t *testing.T) {
+	if BasicAuthorization("Aladdin", "open sesame") != "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==" {
+		t.Fatalf("Got unexpected basic authorization = %v", BasicAuthorization("Aladdin", "open sesame"))
+	}
+}
+
+func TestConnectUpstreamBasicAuth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if req.Header.Get("Proxy-Authorization") != BasicAuthorization("user", "pass") {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"test\"\r\nContent-Length: 0\r\n\r\n"))
+				continue
+			}
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return
+		}
+	}()
+
+	global_config = &config{Credentials: []credential{{Host: "127.0.0.1", Username: "user", Password: "pass"}}}
+	defer func() { global_config = &config{} }()
+
+	conn, err := ConnectUpstream(route{Type: "PROXY", Address: listener.Addr().String()}, "example.com:443")
+	if err != nil {
+		t.Fatalf("Error calling ConnectUpstream: %v", err)
+	}
+	conn.Close()
+}
+
+func TestRouteTransportBasicAuthPost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Proxy-Authorization") != BasicAuthorization("user", "pass") {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	global_config = &config{Credentials: []credential{{Host: "127.0.0.1", Username: "user", Password: "pass"}}}
+	upstreamAuths = map[string]*upstreamAuth{}
+	defer func() {
+		global_config = &config{}
+		upstreamAuths = map[string]*upstreamAuth{}
+	}()
+
+	transport := NewRouteTransport(route{Type: "PROXY", Address: upstream.Listener.Addr().String()}, defaultTransportSettings)
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("hello"))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Error calling RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("Expected the body to be sent again with the answer, got %v %q", resp.Status, string(body))
+	}
+}
+
+// startConnectUpstream runs a proxy which answers one CONNECT with response
+func startConnectUpstream(t *testing.T, response string, requests chan<- *http.Request) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		conn.Write([]byte(response))
+	}()
+	return listener.Addr().String()
+}
+
+func TestConnectUpstreamKeepsEarlyData(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	addr := startConnectUpstream(t, "HTTP/1.1 200 Connection established\r\nVia: 1.1 test\r\n\r\nSSH-2.0-test\r\n", requests)
+
+	conn, err := ConnectUpstream(route{Type: "PROXY", Address: addr}, "example.com:22")
+	if err != nil {
+		t.Fatalf("Error calling ConnectUpstream: %v", err)
+	}
+	defer conn.Close()
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "example.com:22" {
+		t.Fatalf("Expected CONNECT with Host example.com:22, got %v with Host %v", req.Method, req.Host)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "SSH-2.0-test\r\n" {
+		t.Fatalf("Expected the data sent after the response, got %q (%v)", line, err)
+	}
+}
+
+func TestConnectUpstreamRefused(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	addr := startConnectUpstream(t, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"corp\"\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n", requests)
+
+	_, err := ConnectUpstream(route{Type: "PROXY", Address: addr}, "example.com:443")
+	var connectErr *upstreamConnectError
+	if !errors.As(err, &connectErr) {
+		t.Fatalf("Expected an upstreamConnectError, got %v", err)
+	}
+	if connectErr.StatusCode != http.StatusProxyAuthRequired || len(connectErr.Challenges) != 2 || connectErr.Challenges[1] != "NTLM" {
+		t.Fatalf("Got unexpected error %#v", connectErr)
+	}
+	if IsRouteFailure(err) {
+		t.Fatalf("A refused CONNECT should not be a route failure")
+	}
+}
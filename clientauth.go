@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const clientAuthRealm = "proxy-the-proxy"
+
+var (
+	clientRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_client_requests",
+		Help: "Total requests from authenticated local clients by user",
+	}, []string{"user"})
+
+	clientAuthFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_client_auth_failures",
+		Help: "Total requests which were refused because the client did not authenticate",
+	})
+)
+
+// clientUsers are the users allowed to use the proxy listener, the file has
+// one user:hash per line in the format written by htpasswd -B
+type clientUsers struct {
+	hashes map[string][]byte
+	// dummy is checked for unknown users so they take as long as known ones
+	dummy []byte
+	// checking bcrypt hashes is slow so remember the passwords which have already worked
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]string
+}
+
+func LoadClientUsers(path string) (*clientUsers, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf(`LoadClientUsers: error reading %v: %v`, path, err)
+		return nil, err
+	}
+	defer f.Close()
+	u := &clientUsers{hashes: map[string][]byte{}, verified: map[[sha256.Size]byte]string{}}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	cost := bcrypt.DefaultCost
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, errors.New(fmt.Sprintf("%v line %v is not user:hash", path, line))
+		}
+		c, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v line %v does not have a bcrypt hash: %v", path, line, err))
+		}
+		if len(u.hashes) == 0 || c > cost {
+			cost = c
+		}
+		u.hashes[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if u.dummy, err = bcrypt.GenerateFromPassword([]byte("not anyone's password"), cost); err != nil {
+		return nil, err
+	}
+	log.Printf(`LoadClientUsers: loaded %v, %v users`, path, len(u.hashes))
+	return u, nil
+}
+
+// Authenticate checks the Proxy-Authorization header and returns the username
+func (u *clientUsers) Authenticate(req *http.Request) (string, bool) {
+	scheme, encoded, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	user, password, _ := strings.Cut(string(decoded), ":")
+	if !u.CheckPassword(user, password) {
+		return "", false
+	}
+	return user, true
+}
+
+// CheckPassword checks a username and password against the htpasswd file
+func (u *clientUsers) CheckPassword(user string, password string) bool {
+	key := sha256.Sum256([]byte(user + ":" + password))
+	u.mu.Lock()
+	verified, ok := u.verified[key]
+	u.mu.Unlock()
+	if ok && verified == user {
+		return true
+	}
+
+	hash, ok := u.hashes[user]
+	if !ok {
+		// don't let the time taken give away which users exist
+		bcrypt.CompareHashAndPassword(u.dummy, []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	u.mu.Lock()
+	u.verified[key] = user
+	u.mu.Unlock()
+	return true
+}
+
+// ChallengeClient sends the 407 which asks the client for credentials
+func ChallengeClient(wr http.ResponseWriter) {
+	wr.Header().Set("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%v"`, clientAuthRealm))
+	http.Error(wr, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeClientUsers(t *testing.T, user string, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("# proxy users\n"+user+":"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatalf("Error writing users file: %v", err)
+	}
+	return path
+}
+
+func TestClientUsersAuthenticate(t *testing.T) {
+	users, err := LoadClientUsers(writeClientUsers(t, "alice", "secret"))
+	if err != nil {
+		t.Fatalf("Error calling LoadClientUsers: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if _, ok := users.Authenticate(req); ok {
+		t.Fatalf("Expected a request without credentials to fail")
+	}
+	req.Header.Set("Proxy-Authorization", BasicAuthorization("alice", "wrong"))
+	if _, ok := users.Authenticate(req); ok {
+		t.Fatalf("Expected a wrong password to fail")
+	}
+	req.Header.Set("Proxy-Authorization", BasicAuthorization("alice", "secret"))
+	for i := 0; i < 2; i++ {
+		user, ok := users.Authenticate(req)
+		if !ok || user != "alice" {
+			t.Fatalf("Got user = %v, ok = %v, expected alice", user, ok)
+		}
+	}
+}
+
+func TestClientUsersUnknownUser(t *testing.T) {
+	users, err := LoadClientUsers(writeClientUsers(t, "alice", "secret"))
+	if err != nil {
+		t.Fatalf("Error calling LoadClientUsers: %v", err)
+	}
+	// unknown users are checked against a hash which costs the same as the real ones
+	if cost, err := bcrypt.Cost(users.dummy); err != nil || cost != bcrypt.MinCost {
+		t.Fatalf("Expected a dummy hash with cost %v, got %v (%v)", bcrypt.MinCost, cost, err)
+	}
+	if users.CheckPassword("bob", "secret") {
+		t.Fatalf("Expected an unknown user to fail")
+	}
+}
+
+func TestLoadClientUsersRejectsPlainText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(path, []byte("alice:secret\n"), 0600)
+	if _, err := LoadClientUsers(path); err == nil {
+		t.Fatalf("Expected an error for a password which is not hashed")
+	}
+}
+
+func TestServeHTTPChallengesClient(t *testing.T) {
+	users, err := LoadClientUsers(writeClientUsers(t, "alice", "secret"))
+	if err != nil {
+		t.Fatalf("Error calling LoadClientUsers: %v", err)
+	}
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.users = users
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil))
+	if rec.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("Got status %v, expected 407", rec.Code)
+	}
+	if rec.Header().Get("Proxy-Authenticate") != `Basic realm="proxy-the-proxy"` {
+		t.Fatalf("Got unexpected challenge = %v", rec.Header().Get("Proxy-Authenticate"))
+	}
+}
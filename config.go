@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// credential is a username and password for an upstream proxy
+// Host is either a host name (matching any port) or host:port
+// Domain is only used for NTLM
+type credential struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Domain   string `json:"domain,omitempty"`
+}
+
+// config holds the settings which are too complex for command line flags
+type config struct {
+	Credentials []credential     `json:"credentials"`
+	Kerberos    *kerberosConfig  `json:"kerberos,omitempty"`
+	Tunnels     []tunnelTimeouts `json:"tunnels,omitempty"`
+	Limits      []limitRule      `json:"limits,omitempty"`
+	Policy      *policyConfig    `json:"policy,omitempty"`
+	DNS         *dnsConfig       `json:"dns,omitempty"`
+}
+
+var global_config = &config{}
+
+func LoadConfig(path string) (*config, error) {
+	c := &config{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf(`LoadConfig: error reading %v: %v`, path, err)
+		return nil, err
+	}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		log.Printf(`LoadConfig: error parsing %v: %v`, path, err)
+		return nil, err
+	}
+	log.Printf(`LoadConfig: loaded %v, %v credentials`, path, len(c.Credentials))
+	return c, nil
+}
+
+// CredentialFor finds the credentials to use for the proxy at address
+// an entry with a matching host:port wins over one which only matches the host
+func (c *config) CredentialFor(address string) *credential {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	var found *credential
+	for i, cred := range c.Credentials {
+		if strings.EqualFold(cred.Host, address) {
+			return &c.Credentials[i]
+		}
+		if found == nil && strings.EqualFold(cred.Host, host) {
+			found = &c.Credentials[i]
+		}
+	}
+	return found
+}
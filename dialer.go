@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const upstreamDialTimeout = 10 * time.Second
+
+// upstreamProxyRootCAs are trusted for TLS connections to HTTPS proxies, nil means the system roots
+var upstreamProxyRootCAs *x509.CertPool
+
+// LoadCertPool adds the PEM certificates in path to the system roots, so
+// proxies with certificates from an internal CA can be used
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		log.Printf(`LoadCertPool: could not load the system roots, only using %v: %v`, path, err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(fmt.Sprintf("no PEM certificates found in %v", path))
+	}
+	return pool, nil
+}
+
+// DialUpstream opens a connection to the proxy server named in a route
+// HTTPS proxies are wrapped in TLS, everything else is plain TCP
+func DialUpstream(r route) (net.Conn, error) {
+	return dialUpstreamWith(&net.Dialer{Timeout: upstreamDialTimeout}, r)
+}
+
+func dialUpstreamWith(dialer *net.Dialer, r route) (net.Conn, error) {
+	if r.Type != "HTTPS" {
+		return dialer.Dial("tcp", r.Address)
+	}
+	host, _, err := net.SplitHostPort(r.Address)
+	if err != nil {
+		host = r.Address
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", r.Address, &tls.Config{ServerName: host, RootCAs: upstreamProxyRootCAs})
+	if err != nil {
+		log.Printf(`DialUpstream: TLS connection to %v failed: %v`, r.Address, err)
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	return conn, nil
+}
+
+// DialRoute returns a connection to host which goes via the route
+func DialRoute(r route, host string) (net.Conn, error) {
+	switch r.Type {
+	case "DIRECT":
+		log.Printf(`DialRoute: going direct for %v`, host)
+		return global_resolver.Dial("tcp", host, upstreamDialTimeout)
+	case "SOCKS4":
+		return DialSocks4(r, host)
+	case "SOCKS5":
+		return DialSocks5(r, host)
+	default:
+		return ConnectUpstream(r, host)
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"log"
-	"net"
 	"os"
 	"strings"
 )
@@ -94,7 +94,7 @@ func GetDomainFromHostname() (string, error) {
 
 func PerformDNSLookup(host string) interface{} {
 	log.Printf("PerformDNSLookup: %s", host)
-	ips, err := net.LookupIP(host)
+	ips, err := global_resolver.LookupIP(context.Background(), host)
 	if err != nil {
 		log.Println(err)
 		return false
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+var activeTunnels = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "proxy_active_tunnels",
+	Help: "Number of tunnels (CONNECT, upgrades and intercepted connections) which are open",
+})
+
+// activeConns tracks connections which have been hijacked from the http.Servers,
+// Shutdown does not know about them so they have to be drained separately
+type activeConns struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+// trackedConn is one tunnel, closing it closes every connection in it
+type trackedConn struct {
+	closers []io.Closer
+}
+
+func (t *trackedConn) Close() error {
+	for _, c := range t.closers {
+		c.Close()
+	}
+	return nil
+}
+
+func NewActiveConns() *activeConns {
+	return &activeConns{conns: map[*trackedConn]struct{}{}}
+}
+
+// Track records the closers as one active connection until done is called
+// if one of them has a Shutdown method it is called when draining starts
+func (a *activeConns) Track(closers ...io.Closer) (done func()) {
+	t := &trackedConn{closers: closers}
+	a.mu.Lock()
+	a.conns[t] = struct{}{}
+	a.mu.Unlock()
+	activeTunnels.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			delete(a.conns, t)
+			a.mu.Unlock()
+			activeTunnels.Dec()
+		})
+	}
+}
+
+// Tunnel runs a tunnel between x and y, the tunnel is tracked until it closes
+func (a *activeConns) Tunnel(x io.ReadWriteCloser, y io.ReadWriteCloser, options tunnelOptions) {
+	t := NewTunnel(x, y, options)
+	done := a.Track(t)
+	go func() {
+		t.Run()
+		done()
+	}()
+}
+
+func (a *activeConns) Count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.conns)
+}
+
+// Drain waits for the connections to finish by themselves, anything still open
+// when ctx is done is closed
+func (a *activeConns) Drain(ctx context.Context) error {
+	a.mu.Lock()
+	for t := range a.conns {
+		for _, c := range t.closers {
+			if s, ok := c.(interface {
+				Shutdown(context.Context) error
+			}); ok {
+				go s.Shutdown(ctx)
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		count := a.Count()
+		if count == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf(`activeConns: closing %v connections which did not finish in time`, count)
+			a.mu.Lock()
+			for t := range a.conns {
+				t.Close()
+			}
+			a.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops the servers taking new connections and waits up to timeout for
+// the requests and tunnels which are open to finish
+func Shutdown(timeout time.Duration, servers []*http.Server, conns *activeConns) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf(`Shutdown: server on %v did not stop in time: %v`, server.Addr, err)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+	// handlers can hijack connections right up until the servers have stopped
+	conns.Drain(ctx)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForTunnels(t *testing.T) {
+	conns := NewActiveConns()
+	a, b := net.Pipe()
+	c, d := net.Pipe()
+	conns.Tunnel(b, c, tunnelOptions{Name: "test"})
+	if conns.Count() != 1 {
+		t.Fatalf("Got %v active connections, expected 1", conns.Count())
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		a.Close()
+		d.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := conns.Drain(ctx); err != nil {
+		t.Fatalf("Expected the tunnel to finish by itself, got %v", err)
+	}
+}
+
+func TestDrainClosesAfterDeadline(t *testing.T) {
+	conns := NewActiveConns()
+	a, b := net.Pipe()
+	c, d := net.Pipe()
+	defer a.Close()
+	defer d.Close()
+	conns.Tunnel(b, c, tunnelOptions{Name: "test"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conns.Drain(ctx); err == nil {
+		t.Fatalf("Expected the deadline to pass")
+	}
+	// the client side sees the tunnel close
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := a.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expected the tunnel to be closed")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+/*
+ * Captures plain HTTP (and intercepted HTTPS) requests in HAR 1.2 format
+ * http://www.softwareishard.com/blog/har-12-spec/
+ */
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// the capture stops taking new entries once it has this many
+const harMaxEntries = 10000
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	// custom fields have to start with _
+	Route  string `json:"_route"`
+	Client string `json:"_client"`
+	User   string `json:"_user,omitempty"`
+	Error  string `json:"_error,omitempty"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+// headers which carry credentials are kept in captures but without their values
+var harRedactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	list := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if harRedactedHeaders[http.CanonicalHeaderKey(name)] {
+				value = "[redacted]"
+			}
+			list = append(list, harNameValue{name, value})
+		}
+	}
+	return list
+}
+
+func harMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	max   int
+	total int64
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	if room := c.max - c.buf.Len(); room > 0 {
+		if len(p) > room {
+			c.buf.Write(p[:room])
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// text returns the body as HAR text, binary bodies are base64 encoded
+func (c *cappedBuffer) text() (text string, encoding string, comment string) {
+	if c.buf.Len() < int(c.total) {
+		comment = fmt.Sprintf("truncated to %v of %v bytes", c.buf.Len(), c.total)
+	}
+	if utf8.Valid(c.buf.Bytes()) {
+		return c.buf.String(), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(c.buf.Bytes()), "base64", comment
+}
+
+// teeBody copies what is read from a body into a cappedBuffer
+type teeBody struct {
+	io.ReadCloser
+	buf *cappedBuffer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.buf.Write(p[:n])
+	return n, err
+}
+
+// harRecorder collects entries while capture is turned on
+type harRecorder struct {
+	dir     string
+	mu      sync.Mutex
+	enabled bool
+	hosts   hostPatterns
+	maxBody int
+	started time.Time
+	entries []harEntry
+}
+
+func NewHarRecorder(dir string) *harRecorder {
+	return &harRecorder{dir: dir}
+}
+
+// Start throws away anything captured so far and starts capturing requests to
+// hosts (everything if there are none), bodies are kept up to maxBody bytes
+// (0 means no bodies), it returns the patterns being captured
+func (h *harRecorder) Start(hosts hostPatterns, maxBody int) hostPatterns {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(hosts) == 0 {
+		hosts = hostPatterns{"*"}
+	}
+	h.enabled = true
+	h.hosts = hosts
+	h.maxBody = maxBody
+	h.started = time.Now()
+	h.entries = nil
+	log.Printf(`harRecorder: capture started for %v, bodies up to %v bytes`, hosts, maxBody)
+	return hosts
+}
+
+// Stop turns capture off and writes the file, it returns the path and the number of entries
+func (h *harRecorder) Stop() (string, int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.enabled {
+		return "", 0, fmt.Errorf("capture is not running")
+	}
+	h.enabled = false
+	path := filepath.Join(h.dir, fmt.Sprintf("proxy-the-proxy-%v.har", h.started.Format("20060102-150405")))
+	data, err := json.MarshalIndent(h.har(), "", "  ")
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", 0, err
+	}
+	log.Printf(`harRecorder: capture stopped, wrote %v entries to %v`, len(h.entries), path)
+	return path, len(h.entries), nil
+}
+
+// har returns the entries captured so far, h.mu must be held
+func (h *harRecorder) har() harFile {
+	entries := append([]harEntry{}, h.entries...)
+	return harFile{harLog{Version: "1.2", Creator: harCreator{"proxy-the-proxy", "0.1"}, Entries: entries}}
+}
+
+// HAR returns what has been captured so far
+func (h *harRecorder) HAR() harFile {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.har()
+}
+
+func (h *harRecorder) Running() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.enabled
+}
+
+// Capture starts an entry for req, it returns nil when req isn't being captured
+func (h *harRecorder) Capture(req *http.Request, user string) *harCapture {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.enabled || !h.hosts.Match(req.URL.Host) {
+		return nil
+	}
+	c := &harCapture{recorder: h, start: time.Now(), maxBody: h.maxBody}
+	c.entry.Client = req.RemoteAddr
+	if user != "-" {
+		c.entry.User = user
+	}
+	return c
+}
+
+func (h *harRecorder) add(entry harEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.enabled {
+		return
+	}
+	if len(h.entries) >= harMaxEntries {
+		log.Printf(`harRecorder: capture is full, dropping entry for %v`, entry.Request.URL)
+		return
+	}
+	h.entries = append(h.entries, entry)
+}
+
+// harCapture builds one entry as the request goes through the proxy
+type harCapture struct {
+	recorder    *harRecorder
+	entry       harEntry
+	start       time.Time
+	wait        time.Duration
+	maxBody     int
+	requestBody *cappedBuffer
+	body        *cappedBuffer
+}
+
+// Request records the request as it is sent upstream, the body is read through the capture
+func (c *harCapture) Request(req *http.Request) {
+	if c == nil {
+		return
+	}
+	query := []harNameValue{}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			query = append(query, harNameValue{name, value})
+		}
+	}
+	c.entry.Request = harRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(req.Header),
+		QueryString: query,
+		HeadersSize: -1,
+		BodySize:    req.ContentLength,
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		c.requestBody = &cappedBuffer{max: c.maxBody}
+		req.Body = &teeBody{req.Body, c.requestBody}
+	}
+}
+
+// Response records the response headers and which route it came through
+func (c *harCapture) Response(resp *http.Response, r route) {
+	if c == nil {
+		return
+	}
+	c.wait = time.Since(c.start)
+	c.entry.Route = r.String()
+	c.entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(resp.Header),
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+	// an upgraded connection is not a body, it has to be left alone for the tunnel
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		c.body = &cappedBuffer{max: c.maxBody}
+		resp.Body = &teeBody{resp.Body, c.body}
+	}
+}
+
+// Finish adds the entry to the capture, err is set if the request failed
+func (c *harCapture) Finish(err error) {
+	if c == nil {
+		return
+	}
+	total := time.Since(c.start)
+	c.entry.StartedDateTime = c.start.Format(time.RFC3339Nano)
+	c.entry.Time = harMillis(total)
+	if err != nil {
+		c.entry.Error = err.Error()
+		c.entry.Response = harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+		c.entry.Timings = harTimings{Wait: harMillis(total)}
+	} else {
+		c.entry.Timings = harTimings{Wait: harMillis(c.wait), Receive: harMillis(total - c.wait)}
+	}
+	if c.requestBody != nil {
+		c.entry.Request.BodySize = c.requestBody.total
+		if c.maxBody > 0 {
+			text, encoding, comment := c.requestBody.text()
+			c.entry.Request.PostData = &harPostData{MimeType: c.entry.requestHeader("Content-Type"), Text: text, Encoding: encoding, Comment: comment}
+		}
+	}
+	if c.body != nil {
+		c.entry.Response.BodySize = c.body.total
+		c.entry.Response.Content.Size = c.body.total
+		if c.maxBody > 0 {
+			c.entry.Response.Content.Text, c.entry.Response.Content.Encoding, c.entry.Response.Content.Comment = c.body.text()
+		}
+	}
+	c.recorder.add(c.entry)
+}
+
+func (e *harEntry) requestHeader(name string) string {
+	for _, h := range e.Request.Headers {
+		if http.CanonicalHeaderKey(h.Name) == http.CanonicalHeaderKey(name) {
+			return h.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHarCapture(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("you sent " + string(body)))
+	}))
+	defer target.Close()
+
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.har = NewHarRecorder(t.TempDir())
+	p.har.Start(ParseHostPatterns("127.0.0.1"), 8)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(target.URL+"/path?q=1", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Error calling Post: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// the entry is added just after the response has been sent
+	for i := 0; i < 100 && len(p.har.HAR().Log.Entries) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	path, count, err := p.har.Stop()
+	if err != nil || count != 1 {
+		t.Fatalf("Got %v entries, %v, expected 1", count, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading HAR: %v", err)
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("Error parsing HAR: %v", err)
+	}
+	entry := har.Log.Entries[0]
+	if har.Log.Version != "1.2" || entry.Route != "DIRECT" || entry.Request.Method != "POST" {
+		t.Fatalf("Got unexpected entry = %+v", entry)
+	}
+	if len(entry.Request.QueryString) != 1 || entry.Request.PostData == nil || entry.Request.PostData.Text != "hello" {
+		t.Fatalf("Got unexpected request = %+v", entry.Request)
+	}
+	content := entry.Response.Content
+	if entry.Response.Status != 200 || content.Size != int64(len("you sent hello")) || content.Text != "you sent" || content.Comment == "" {
+		t.Fatalf("Got unexpected response = %+v", entry.Response)
+	}
+}
+
+func TestHarCaptureOnlyMatchingHosts(t *testing.T) {
+	h := NewHarRecorder(t.TempDir())
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if h.Capture(req, "-") != nil {
+		t.Fatalf("Expected no capture before Start")
+	}
+	h.Start(ParseHostPatterns("*.example.org"), 0)
+	if h.Capture(req, "-") != nil {
+		t.Fatalf("Expected no capture for a host which doesn't match")
+	}
+	if h.Capture(httptest.NewRequest(http.MethodGet, "http://www.example.org/", nil), "-") == nil {
+		t.Fatalf("Expected a capture for a matching host")
+	}
+}
+
+func TestCappedBufferBinary(t *testing.T) {
+	c := &cappedBuffer{max: 2}
+	c.Write([]byte{0xff, 0xfe, 0xfd})
+	text, encoding, comment := c.text()
+	if text != "//4=" || encoding != "base64" || comment != "truncated to 2 of 3 bytes" {
+		t.Fatalf("Got unexpected text = %v, %v, %v", text, encoding, comment)
+	}
+}
+
+func TestHarHeadersRedacted(t *testing.T) {
+	header := http.Header{}
+	header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	header.Set("Authorization", "Bearer secret")
+	header.Add("Cookie", "session=secret")
+	header.Set("Accept", "text/plain")
+	for _, h := range harHeaders(header) {
+		if strings.Contains(h.Value, "secret") || strings.Contains(h.Value, "dXNl") {
+			t.Fatalf("Expected %v to be redacted, got %v", h.Name, h.Value)
+		}
+		if h.Name == "Accept" && h.Value != "text/plain" {
+			t.Fatalf("Expected Accept to be kept, got %v", h.Value)
+		}
+	}
+}
+
+func TestMgmtHarStartNeedsPost(t *testing.T) {
+	old := global_proxy
+	global_proxy = NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	global_proxy.har = NewHarRecorder(t.TempDir())
+	defer func() { global_proxy = old }()
+	server := CreateMgmtServer("127.0.0.1:0")
+
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/har/start", nil))
+	if rec.Code != http.StatusMethodNotAllowed || global_proxy.har.Running() {
+		t.Fatalf("Expected GET not to start a capture, got %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/har/start", nil))
+	if rec.Code != http.StatusOK || !global_proxy.har.Running() {
+		t.Fatalf("Expected POST to start a capture, got %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/har/stop", nil))
+	if rec.Code != http.StatusMethodNotAllowed || !global_proxy.har.Running() {
+		t.Fatalf("Expected GET not to stop the capture, got %v", rec.Code)
+	}
+}
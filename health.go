@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// upstreams which haven't been returned by the PAC for this long stop being checked
+const healthForgetAfter = time.Hour
+
+var upstreamUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "proxy_upstream_up",
+	Help: "Whether an upstream proxy is up (1) or its circuit breaker is open (0)",
+}, []string{"upstream"})
+
+var upstreamHealthChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_upstream_health_checks",
+	Help: "Total health checks of upstream proxies by result",
+}, []string{"upstream", "result"})
+
+// healthSettings control the health checks, an Interval of 0 turns them off
+type healthSettings struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Failures in a row which mark an upstream as down
+	Failures int
+}
+
+// upstreamState is what is known about one upstream proxy
+type upstreamState struct {
+	route     route
+	down      bool
+	failures  int
+	since     time.Time
+	lastCheck time.Time
+	lastError string
+	lastSeen  time.Time
+}
+
+// upstreamStatus is how an upstream is shown on the status page
+type upstreamStatus struct {
+	Upstream  string     `json:"upstream"`
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	Since     time.Time  `json:"since"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// upstreamHealth checks the upstream proxies the PAC has returned in the
+// background and opens a circuit breaker for each one which keeps failing,
+// requests skip upstreams which are down until a check succeeds again
+type upstreamHealth struct {
+	settings  healthSettings
+	probe     func(r route, timeout time.Duration) error
+	mu        sync.Mutex
+	upstreams map[string]*upstreamState
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// probeUpstream checks a TCP connection (and TLS for HTTPS proxies) can be made
+func probeUpstream(r route, timeout time.Duration) error {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialUpstreamWith(dialer, r)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// NewUpstreamHealth starts checking upstreams, it returns nil when checks are off
+func NewUpstreamHealth(settings healthSettings) *upstreamHealth {
+	if settings.Interval <= 0 {
+		return nil
+	}
+	if settings.Failures < 1 {
+		settings.Failures = 1
+	}
+	h := &upstreamHealth{
+		settings:  settings,
+		probe:     probeUpstream,
+		upstreams: map[string]*upstreamState{},
+		stop:      make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// Close stops the background checks
+func (h *upstreamHealth) Close() {
+	if h == nil {
+		return
+	}
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+func (h *upstreamHealth) run() {
+	ticker := time.NewTicker(h.settings.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.CheckAll()
+		}
+	}
+}
+
+// CheckAll probes every known upstream once and forgets those not used for a while
+func (h *upstreamHealth) CheckAll() {
+	h.mu.Lock()
+	var routes []route
+	for key, s := range h.upstreams {
+		if time.Since(s.lastSeen) > healthForgetAfter {
+			log.Printf(`upstreamHealth: no longer checking %v`, key)
+			delete(h.upstreams, key)
+			upstreamUp.DeleteLabelValues(key)
+			continue
+		}
+		routes = append(routes, s.route)
+	}
+	probe := h.probe
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, r := range routes {
+		wg.Add(1)
+		go func(r route) {
+			defer wg.Done()
+			err := probe(r, h.settings.Timeout)
+			result := "ok"
+			if err != nil {
+				result = "failed"
+			}
+			upstreamHealthChecks.WithLabelValues(r.String(), result).Inc()
+			h.record(r, err, true)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// state finds or adds the state for r, h.mu must be held
+func (h *upstreamHealth) state(r route) *upstreamState {
+	s, ok := h.upstreams[r.String()]
+	if !ok {
+		now := time.Now()
+		s = &upstreamState{route: r, since: now, lastSeen: now}
+		h.upstreams[r.String()] = s
+		upstreamUp.WithLabelValues(r.String()).Set(1)
+	}
+	return s
+}
+
+// record updates the circuit breaker for r after a check or a request
+func (h *upstreamHealth) record(r route, err error, check bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.state(r)
+	if check {
+		s.lastCheck = time.Now()
+	}
+	if err == nil {
+		s.failures = 0
+		s.lastError = ""
+		if s.down {
+			log.Printf(`upstreamHealth: %v is back up`, r)
+			s.down = false
+			s.since = time.Now()
+			upstreamUp.WithLabelValues(r.String()).Set(1)
+		}
+		return
+	}
+	s.failures++
+	s.lastError = err.Error()
+	if !s.down && s.failures >= h.settings.Failures {
+		log.Printf(`upstreamHealth: %v is down after %v failures, last error: %v`, r, s.failures, err)
+		s.down = true
+		s.since = time.Now()
+		upstreamUp.WithLabelValues(r.String()).Set(0)
+	}
+}
+
+// Report records the result of using r for a request
+func (h *upstreamHealth) Report(r route, err error) {
+	if h == nil || r.IsDirect() {
+		return
+	}
+	h.record(r, err, false)
+}
+
+// Filter starts checking any new upstreams in routes and drops the ones which
+// are down, if every route is down they are all returned as a last resort
+func (h *upstreamHealth) Filter(routes []route) []route {
+	if h == nil {
+		return routes
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	up := []route{}
+	for _, r := range routes {
+		if r.IsDirect() {
+			up = append(up, r)
+			continue
+		}
+		s := h.state(r)
+		s.lastSeen = time.Now()
+		if !s.down {
+			up = append(up, r)
+		} else {
+			log.Printf(`upstreamHealth: skipping %v as it is down`, r)
+		}
+	}
+	if len(up) == 0 {
+		return routes
+	}
+	return up
+}
+
+func (h *upstreamHealth) MarshalJSON() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := []upstreamStatus{}
+	for key, s := range h.upstreams {
+		u := upstreamStatus{Upstream: key, State: "up", Failures: s.failures, Since: s.since, LastError: s.lastError}
+		if s.down {
+			u.State = "down"
+		}
+		if !s.lastCheck.IsZero() {
+			last := s.lastCheck
+			u.LastCheck = &last
+		}
+		status = append(status, u)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Upstream < status[j].Upstream })
+	return json.Marshal(status)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealthCircuitBreaker(t *testing.T) {
+	h := NewUpstreamHealth(healthSettings{Interval: time.Hour, Timeout: time.Second, Failures: 3})
+	defer h.Close()
+	var failing int32 = 1
+	h.probe = func(r route, timeout time.Duration) error {
+		if atomic.LoadInt32(&failing) == 1 && r.Address == "a:8080" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	a := route{Type: "PROXY", Address: "a:8080"}
+	b := route{Type: "PROXY", Address: "b:8080"}
+	routes := []route{a, b, directRoute}
+	if got := RoutesToString(h.Filter(routes)); got != "PROXY a:8080; PROXY b:8080; DIRECT" {
+		t.Fatalf("Got %v, expected every route", got)
+	}
+
+	// a request failure and two failed checks open the breaker
+	h.Report(a, errors.New("dial failed"))
+	h.CheckAll()
+	if got := RoutesToString(h.Filter(routes)); got != "PROXY a:8080; PROXY b:8080; DIRECT" {
+		t.Fatalf("Got %v, expected a to still be used", got)
+	}
+	h.CheckAll()
+	if got := RoutesToString(h.Filter(routes)); got != "PROXY b:8080; DIRECT" {
+		t.Fatalf("Got %v, expected a to be skipped", got)
+	}
+	// with nothing else left a down upstream is still tried
+	if got := RoutesToString(h.Filter([]route{a})); got != "PROXY a:8080" {
+		t.Fatalf("Got %v, expected a as a last resort", got)
+	}
+
+	var status []upstreamStatus
+	b2, _ := json.Marshal(h)
+	if err := json.Unmarshal(b2, &status); err != nil || len(status) != 2 {
+		t.Fatalf("Got unexpected status %v, %v", string(b2), err)
+	}
+	if status[0].State != "down" || status[0].Failures != 3 || status[0].LastError != "connection refused" || status[0].LastCheck == nil {
+		t.Fatalf("Got unexpected status %+v", status[0])
+	}
+
+	// the recovery check brings it back
+	atomic.StoreInt32(&failing, 0)
+	h.CheckAll()
+	if got := RoutesToString(h.Filter(routes)); got != "PROXY a:8080; PROXY b:8080; DIRECT" {
+		t.Fatalf("Got %v, expected a to be back", got)
+	}
+}
+
+func TestUpstreamHealthChecksInBackground(t *testing.T) {
+	h := NewUpstreamHealth(healthSettings{Interval: 10 * time.Millisecond, Timeout: time.Second, Failures: 2})
+	defer h.Close()
+	h.mu.Lock()
+	h.probe = func(r route, timeout time.Duration) error {
+		return errors.New("timeout")
+	}
+	h.mu.Unlock()
+
+	a := route{Type: "PROXY", Address: "a:8080"}
+	h.Filter([]route{a})
+	for i := 0; i < 100; i++ {
+		if len(h.Filter([]route{a, directRoute})) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected the background checks to mark the upstream as down")
+}
+
+func TestProbeUpstream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	addr := l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	if err := probeUpstream(route{Type: "PROXY", Address: addr}, time.Second); err != nil {
+		t.Fatalf("Expected the probe to work, got %v", err)
+	}
+	l.Close()
+	if err := probeUpstream(route{Type: "PROXY", Address: addr}, time.Second); err == nil {
+		t.Fatalf("Expected the probe to fail once the listener is closed")
+	}
+	if NewUpstreamHealth(healthSettings{}) != nil {
+		t.Fatalf("Expected no health checks with no interval")
+	}
+}
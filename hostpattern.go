@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// hostPatterns is a list of host names to match against
+// "example.com" only matches itself, "*.example.com" matches the subdomains,
+// ".example.com" matches both and "*" matches everything
+type hostPatterns []string
+
+func ParseHostPatterns(value string) hostPatterns {
+	var patterns hostPatterns
+	for _, entry := range splitList(value) {
+		patterns = append(patterns, strings.TrimSuffix(strings.ToLower(entry), "."))
+	}
+	return patterns
+}
+
+// normaliseHost drops the port, any brackets and the trailing dot from host
+func normaliseHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func MatchHostPattern(pattern string, host string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+	return host == pattern
+}
+
+// Match checks host (which may have a port) against every pattern
+func (h hostPatterns) Match(host string) bool {
+	host = normaliseHost(host)
+	for _, pattern := range h {
+		if MatchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var clientDenied = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "proxy_client_denied",
+	Help: "Total requests refused because the client address is not allowed",
+})
+
+// splitList splits a comma separated flag value and drops empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// ListenAddresses turns a comma separated list of hosts into host:port addresses
+// entries which already have a port keep it, IPv6 addresses can be given with or without []
+func ListenAddresses(value string, port int) ([]string, error) {
+	var addrs []string
+	for _, entry := range splitList(value) {
+		if host, p, err := net.SplitHostPort(entry); err == nil {
+			if _, err := strconv.Atoi(p); err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid port in listen address %v", entry))
+			}
+			addrs = append(addrs, net.JoinHostPort(host, p))
+			continue
+		}
+		host := strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen addresses given")
+	}
+	return addrs, nil
+}
+
+// IsLoopbackListen is true for listen addresses only local clients can reach
+func IsLoopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// clientACL decides which client addresses may use the proxy
+// a deny entry always wins, an empty allow list allows everyone else
+type clientACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range splitList(value) {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("invalid address %v", entry))
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func NewClientACL(allow string, deny string) (*clientACL, error) {
+	a, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &clientACL{allow: a, deny: d}, nil
+}
+
+func (a *clientACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address the request came from without the port
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// AllowedRequest checks the address the request came from
+func (a *clientACL) AllowedRequest(req *http.Request) bool {
+	allowed := a.Allowed(net.ParseIP(ClientIP(req)))
+	if !allowed {
+		log.Printf(`clientACL: refusing request from %v`, req.RemoteAddr)
+	}
+	return allowed
+}
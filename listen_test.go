@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestListenAddresses(t *testing.T) {
+	addrs, err := ListenAddresses("127.0.0.1, ::1, [fe80::1%eth0], 172.17.0.1:3128", 8080)
+	if err != nil {
+		t.Fatalf("Error calling ListenAddresses: %v", err)
+	}
+	expected := "127.0.0.1:8080 [::1]:8080 [fe80::1%eth0]:8080 172.17.0.1:3128"
+	if strings.Join(addrs, " ") != expected {
+		t.Fatalf("Got %v, expected %v", addrs, expected)
+	}
+	if _, err := ListenAddresses(" , ", 8080); err == nil {
+		t.Fatalf("Expected an error for an empty list")
+	}
+}
+
+func TestClientACL(t *testing.T) {
+	acl, err := NewClientACL("127.0.0.1, 172.17.0.0/16, ::1", "172.17.0.99")
+	if err != nil {
+		t.Fatalf("Error calling NewClientACL: %v", err)
+	}
+	tests := map[string]bool{
+		"127.0.0.1":         true,
+		"172.17.3.4":        true,
+		"::ffff:172.17.3.4": true,
+		"172.17.0.99":       false,
+		"10.0.0.1":          false,
+		"::1":               true,
+		"2001:db8::1":       false,
+	}
+	for ip, expected := range tests {
+		if acl.Allowed(net.ParseIP(ip)) != expected {
+			t.Fatalf("Got Allowed(%v) = %v, expected %v", ip, !expected, expected)
+		}
+	}
+	if _, err := NewClientACL("not-an-ip", ""); err == nil {
+		t.Fatalf("Expected an error for an invalid entry")
+	}
+}
+
+func TestClientACLDenyOnly(t *testing.T) {
+	acl, _ := NewClientACL("", "10.0.0.0/8")
+	if !acl.Allowed(net.ParseIP("192.168.1.1")) || acl.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Fatalf("Expected only 10.0.0.0/8 to be denied")
+	}
+}
+
+func TestServeHTTPRefusesClient(t *testing.T) {
+	acl, _ := NewClientACL("10.0.0.0/8", "")
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.acl = acl
+	req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	req.RemoteAddr = "192.168.1.1:4000"
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Got status %v, expected 403", rec.Code)
+	}
+}
+
+func TestMgmtServerRefusesClient(t *testing.T) {
+	acl, _ := NewClientACL("10.0.0.0/8", "")
+	old := global_proxy
+	global_proxy = NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	global_proxy.acl = acl
+	defer func() { global_proxy = old }()
+	server := CreateMgmtServer("127.0.0.1:0")
+
+	for _, test := range []struct {
+		client string
+		want   int
+	}{
+		{"192.168.1.1:4000", http.StatusForbidden},
+		{"10.1.2.3:4000", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/throughput", nil)
+		req.RemoteAddr = test.client
+		rec := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Fatalf("Got status %v for %v, expected %v", rec.Code, test.client, test.want)
+		}
+	}
+}
+
+func TestIsLoopbackListen(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:9001": true,
+		"[::1]:9001":     true,
+		"0.0.0.0:9001":   false,
+		":9001":          false,
+		"10.0.0.1:9001":  false,
+	}
+	for addr, want := range tests {
+		if got := IsLoopbackListen(addr); got != want {
+			t.Fatalf("Got %v for %v, expected %v", got, addr, want)
+		}
+	}
+}
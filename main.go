@@ -5,8 +5,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -28,7 +35,7 @@ v%v
 
 var global_proxy *proxy
 
-func CreateMgmtServer(port int) *http.Server {
+func CreateMgmtServer(addr string) *http.Server {
 
 	type resp struct {
 		Status  string
@@ -66,6 +73,12 @@ func CreateMgmtServer(port int) *http.Server {
 		global_proxy.UpdatePac(pac, detected)
 		log.Printf("MgmtServer: Refresh, updated PAC details")
 
+		if err := global_proxy.Overrides.Reload(); err != nil {
+			log.Printf(`MgmtServer: error reloading overrides, keeping the old ones: %v`, err)
+			http.Error(w, fmt.Sprintf("Error reloading overrides: %v", err), http.StatusInternalServerError)
+			return
+		}
+
 		res := &resp{"ok", "refreshed"}
 		b, err := json.Marshal(res)
 		if err != nil {
@@ -75,20 +88,148 @@ func CreateMgmtServer(port int) *http.Server {
 		fmt.Fprintf(w, string(b))
 	})
 
+	mux.HandleFunc("/throughput", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf(`MgmtServer: request for throughput`)
+		b, err := json.Marshal(global_proxy.throttle.Throughput())
+		if err != nil {
+			log.Printf(`MgmtServer: error marshalling JSON %v`, err)
+			http.Error(w, "Error marshalling to JSON for /throughput", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+
+	mux.HandleFunc("/har/start", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf(`MgmtServer: request to start HAR capture`)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Use POST to start a HAR capture", http.StatusMethodNotAllowed)
+			return
+		}
+		maxBody := 0
+		if bodies := r.URL.Query().Get("bodies"); bodies != "" {
+			n, err := strconv.Atoi(bodies)
+			if err != nil || n < 0 {
+				http.Error(w, "bodies must be a number of bytes", http.StatusBadRequest)
+				return
+			}
+			maxBody = n
+		}
+		hosts := global_proxy.har.Start(ParseHostPatterns(r.URL.Query().Get("hosts")), maxBody)
+		b, _ := json.Marshal(&resp{"ok", fmt.Sprintf("capturing %v", hosts)})
+		w.Write(b)
+	})
+
+	mux.HandleFunc("/har/stop", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf(`MgmtServer: request to stop HAR capture`)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Use POST to stop a HAR capture", http.StatusMethodNotAllowed)
+			return
+		}
+		path, count, err := global_proxy.har.Stop()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		b, _ := json.Marshal(&resp{"ok", fmt.Sprintf("wrote %v entries to %v", count, path)})
+		w.Write(b)
+	})
+
+	mux.HandleFunc("/har", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf(`MgmtServer: request for the HAR capture`)
+		b, err := json.Marshal(global_proxy.har.HAR())
+		if err != nil {
+			log.Printf(`MgmtServer: error marshalling JSON %v`, err)
+			http.Error(w, "Error marshalling to JSON for /har", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+
+	mux.HandleFunc("/ca.crt", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf(`MgmtServer: request for the interception CA`)
+		if global_proxy.mitm == nil {
+			http.Error(w, "TLS interception is not turned on", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(global_proxy.mitm.ca.certPEM)
+	})
+
+	pac := func(w http.ResponseWriter, r *http.Request) {
+		if global_proxy.pacFile == nil {
+			http.Error(w, "No PAC file", http.StatusNotFound)
+			return
+		}
+		global_proxy.pacFile.ServeHTTP(w, r)
+	}
+	mux.HandleFunc("/proxy.pac", pac)
+	mux.HandleFunc("/wpad.dat", pac)
+
 	mux.Handle("/metrics", promhttp.Handler())
 
+	// the management server can change settings and shows captured requests
+	// so only the clients allowed to use the proxy can reach it
 	server := http.Server{
-		Addr:    fmt.Sprintf(`127.0.0.1:%v`, port),
-		Handler: mux,
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !global_proxy.acl.AllowedRequest(r) {
+				clientDenied.Inc()
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}),
 	}
 
 	return &server
 }
 
+// defaultCADir is where the interception CA lives unless -mitm-ca-dir says otherwise
+func defaultCADir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "proxy-the-proxy")
+}
+
 func main() {
 	// parameters
 	proxyPort := flag.Int("proxy", 8080, "Port on which to run the proxy server")
 	mgmtPort := flag.Int("mgmt", 9001, "Port on which to run the management server")
+	proxyListen := flag.String("listen", "127.0.0.1", "Comma separated addresses the proxy server listens on")
+	mgmtListen := flag.String("mgmt-listen", "127.0.0.1", "Comma separated addresses the management server listens on")
+	transparentListen := flag.String("transparent", "", "Comma separated addresses for the transparent proxy listener (Linux only), the default port is 3129")
+	socksListen := flag.String("socks", "", "Comma separated addresses for the SOCKS5 listener, the default port is 1080")
+	pacBypass := flag.String("pac-bypass", "", "Comma separated host patterns, IPv4 CIDRs or <local> which the served PAC file sends direct")
+	allowClients := flag.String("allow", "", "Comma separated CIDRs of clients allowed to use the proxy, empty allows all")
+	denyClients := flag.String("deny", "", "Comma separated CIDRs of clients which cannot use the proxy")
+	mitmHosts := flag.String("mitm", "", "Comma separated host patterns of CONNECT tunnels to decrypt, e.g. *.example.com")
+	mitmDir := flag.String("mitm-ca-dir", defaultCADir(), "Directory where the CA used for -mitm is kept")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for requests and tunnels to finish when stopping")
+	var tunnelDefaults tunnelTimeouts
+	flag.DurationVar((*time.Duration)(&tunnelDefaults.Idle), "tunnel-idle-timeout", 15*time.Minute, "Close tunnels which have not sent anything for this long, 0 for no limit")
+	flag.DurationVar((*time.Duration)(&tunnelDefaults.MaxLifetime), "tunnel-max-lifetime", 0, "Close tunnels which have been open for this long, 0 for no limit")
+	harDir := flag.String("har-dir", os.TempDir(), "Directory where HAR captures are written")
+	configFile := flag.String("config", "", "Path to a JSON configuration file")
+	upstreamCA := flag.String("upstream-ca", "", "PEM file of CA certificates trusted for HTTPS upstream proxies as well as the system ones")
+	overridesFile := flag.String("overrides", "", "Path to a JSON file of routes to use instead of the PAC for some destinations")
+	usersFile := flag.String("users", "", "Path to a htpasswd file (bcrypt hashes) of users allowed to use the proxy")
+	accessLogPath := flag.String("access-log", "", "File to write an access log line for each request and tunnel to, - for stdout, empty for none")
+	accessLogFormat := flag.String("access-log-format", "json", "Format of the access log, json or combined")
+	health := healthSettings{}
+	flag.DurationVar(&health.Interval, "health-check-interval", 30*time.Second, "How often upstream proxies are checked, 0 turns the checks off")
+	flag.DurationVar(&health.Timeout, "health-check-timeout", 2*time.Second, "How long a health check waits to connect to an upstream proxy")
+	flag.IntVar(&health.Failures, "health-check-failures", 3, "Failures in a row (checks or requests) before an upstream proxy is skipped")
+	settings := defaultTransportSettings
+	flag.IntVar(&settings.MaxIdleConns, "max-idle-conns", settings.MaxIdleConns, "Maximum number of idle keep-alive connections kept for each route")
+	flag.IntVar(&settings.MaxIdleConnsPerUpstream, "max-idle-conns-per-upstream", settings.MaxIdleConnsPerUpstream, "Maximum number of idle keep-alive connections kept for each upstream proxy or destination host")
+	flag.IntVar(&settings.MaxConnsPerUpstream, "max-conns-per-upstream", settings.MaxConnsPerUpstream, "Maximum number of connections open to each upstream proxy for HTTP requests, 0 for no limit")
+	flag.DurationVar(&settings.IdleConnTimeout, "idle-conn-timeout", settings.IdleConnTimeout, "How long an idle keep-alive connection is kept")
 
 	// print the hello messages
 	// second parameter is the app version number
@@ -97,6 +238,127 @@ func main() {
 	// parse parameters
 	flag.Parse()
 
+	// load the config file if there is one
+	if *configFile != "" {
+		c, err := LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf(`Proxy: could not load config file %v: %v`, *configFile, err)
+		}
+		global_config = c
+	}
+	if *upstreamCA != "" {
+		pool, err := LoadCertPool(*upstreamCA)
+		if err != nil {
+			log.Fatalf(`Proxy: could not load -upstream-ca: %v`, err)
+		}
+		upstreamProxyRootCAs = pool
+	}
+	resolver, err := NewResolver(global_config.DNS)
+	if err != nil {
+		log.Fatalf(`Proxy: bad dns section in config file: %v`, err)
+	}
+	global_resolver = resolver
+	if global_config.Kerberos != nil {
+		log.Printf(`Proxy: Kerberos is configured, Negotiate authentication is enabled`)
+		global_negotiator = NewKerberosNegotiator(*global_config.Kerberos)
+	}
+
+	// work out where to listen and who can connect
+	proxyAddrs, err := ListenAddresses(*proxyListen, *proxyPort)
+	if err != nil {
+		log.Fatalf(`Proxy: bad -listen value: %v`, err)
+	}
+	mgmtAddrs, err := ListenAddresses(*mgmtListen, *mgmtPort)
+	if err != nil {
+		log.Fatalf(`Proxy: bad -mgmt-listen value: %v`, err)
+	}
+	// the transparent listener is only started when asked for
+	var transparentAddrs []string
+	if *transparentListen != "" {
+		transparentAddrs, err = ListenAddresses(*transparentListen, 3129)
+		if err != nil {
+			log.Fatalf(`Proxy: bad -transparent value: %v`, err)
+		}
+	}
+	var socksAddrs []string
+	if *socksListen != "" {
+		socksAddrs, err = ListenAddresses(*socksListen, 1080)
+		if err != nil {
+			log.Fatalf(`Proxy: bad -socks value: %v`, err)
+		}
+	}
+	acl, err := NewClientACL(*allowClients, *denyClients)
+	if err != nil {
+		log.Fatalf(`Proxy: bad -allow or -deny value: %v`, err)
+	}
+	for _, addr := range append(append([]string{}, proxyAddrs...), socksAddrs...) {
+		if !IsLoopbackListen(addr) && *allowClients == "" && *usersFile == "" {
+			log.Printf(`Proxy: WARNING, listening on %v with no -allow list or -users file, anyone who can reach it can use the proxy`, addr)
+		}
+	}
+	// -users does not cover the management server
+	for _, addr := range mgmtAddrs {
+		if !IsLoopbackListen(addr) && *allowClients == "" {
+			log.Printf(`Proxy: WARNING, management server listening on %v with no -allow list, anyone who can reach it can change settings and read HAR captures`, addr)
+		}
+	}
+
+	// load the users who can use the proxy
+	var users *clientUsers
+	if *usersFile != "" {
+		u, err := LoadClientUsers(*usersFile)
+		if err != nil {
+			log.Fatalf(`Proxy: could not load users file %v: %v`, *usersFile, err)
+		}
+		users = u
+	}
+
+	// bandwidth limits
+	limits, err := NewThrottle(global_config.Limits)
+	if err != nil {
+		log.Fatalf(`Proxy: bad limits in config file: %v`, err)
+	}
+
+	// local routes which win over the PAC
+	var overrides *routeOverrides
+	if *overridesFile != "" {
+		overrides, err = LoadRouteOverrides(*overridesFile)
+		if err != nil {
+			log.Fatalf(`Proxy: could not load overrides file %v: %v`, *overridesFile, err)
+		}
+	}
+
+	// destinations clients can reach
+	policy, err := NewDestinationPolicy(global_config.Policy)
+	if err != nil {
+		log.Fatalf(`Proxy: bad policy in config file: %v`, err)
+	}
+
+	// the PAC file for browsers points at the first proxy address
+	pacFile, err := NewPacFile(proxyAddrs[0], *pacBypass)
+	if err != nil {
+		log.Fatalf(`Proxy: bad -pac-bypass value: %v`, err)
+	}
+
+	// open the access log
+	var access *accessLog
+	if *accessLogPath != "" {
+		access, err = NewAccessLog(*accessLogPath, *accessLogFormat)
+		if err != nil {
+			log.Fatalf(`Proxy: could not open access log %v: %v`, *accessLogPath, err)
+		}
+	}
+
+	// set up TLS interception
+	var mitm *interceptor
+	if *mitmHosts != "" {
+		ca, err := LoadOrCreateCA(*mitmDir)
+		if err != nil {
+			log.Fatalf(`Proxy: could not load the CA for -mitm: %v`, err)
+		}
+		mitm = NewInterceptor(ca, ParseHostPatterns(*mitmHosts))
+	}
+
 	// Get my IP address
 	myIpAddress := GetOutboundIP()
 	log.Printf("Proxy: My IP address is %s", myIpAddress)
@@ -116,28 +378,91 @@ func main() {
 	}
 
 	// init proxy
-	global_proxy = NewProxy(pac, myIpAddress.String(), mySearchDomain, detected)
+	global_proxy = NewProxy(pac, myIpAddress.String(), mySearchDomain, detected, settings)
+	global_proxy.users = users
+	global_proxy.acl = acl
+	global_proxy.mitm = mitm
+	global_proxy.tunnelDefaults = tunnelDefaults
+	global_proxy.throttle = limits
+	global_proxy.har = NewHarRecorder(*harDir)
+	global_proxy.accessLog = access
+	global_proxy.pacFile = pacFile
+	global_proxy.policy = policy
+	global_proxy.Overrides = overrides
+	global_proxy.Upstreams = NewUpstreamHealth(health)
 
+	var servers []*http.Server
 	wg := new(sync.WaitGroup)
-	wg.Add(2)
-
-	// mgmt server
-	go func() {
-		log.Printf(`Proxy: spawn mgmt server, port = %d`, *mgmtPort)
-		server := CreateMgmtServer(*mgmtPort)
-		server.ListenAndServe()
-		wg.Done()
-	}()
-
-	// proxy
-	go func() {
-		log.Printf(`Proxy: spawn proxy server, port = %d`, *proxyPort)
-		addr := fmt.Sprintf("127.0.0.1:%d", *proxyPort)
-		if err := http.ListenAndServe(addr, global_proxy); err != nil {
-			log.Fatalln("ListenAndServe", err)
-		}
-	}()
-
-	// wait
+
+	// mgmt servers
+	for _, addr := range mgmtAddrs {
+		server := CreateMgmtServer(addr)
+		servers = append(servers, server)
+		wg.Add(1)
+		go func(addr string) {
+			log.Printf(`Proxy: spawn mgmt server, addr = %v`, addr)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf(`Proxy: mgmt server on %v stopped: %v`, addr, err)
+			}
+			wg.Done()
+		}(addr)
+	}
+
+	// proxy servers
+	for _, addr := range proxyAddrs {
+		server := &http.Server{Addr: addr, Handler: global_proxy}
+		servers = append(servers, server)
+		wg.Add(1)
+		go func(addr string) {
+			log.Printf(`Proxy: spawn proxy server, addr = %v`, addr)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalln("ListenAndServe", err)
+			}
+			wg.Done()
+		}(addr)
+	}
+
+	// transparent listeners
+	var listeners []net.Listener
+	for _, addr := range transparentAddrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf(`Proxy: could not listen on %v for transparent connections: %v`, addr, err)
+		}
+		listeners = append(listeners, l)
+		wg.Add(1)
+		go func(l net.Listener) {
+			log.Printf(`Proxy: spawn transparent listener, addr = %v`, l.Addr())
+			global_proxy.ServeTransparent(l)
+			wg.Done()
+		}(l)
+	}
+
+	// SOCKS5 listeners
+	for _, addr := range socksAddrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf(`Proxy: could not listen on %v for SOCKS5 connections: %v`, addr, err)
+		}
+		listeners = append(listeners, l)
+		wg.Add(1)
+		go func(l net.Listener) {
+			log.Printf(`Proxy: spawn SOCKS5 listener, addr = %v`, l.Addr())
+			global_proxy.ServeSocks(l)
+			wg.Done()
+		}(l)
+	}
+
+	// wait for a signal, a second one stops straight away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	log.Printf(`Proxy: got %v, draining connections for up to %v`, sig, *shutdownTimeout)
+	for _, l := range listeners {
+		l.Close()
+	}
+	Shutdown(*shutdownTimeout, servers, global_proxy.conns)
 	wg.Wait()
+	log.Printf(`Proxy: stopped`)
 }
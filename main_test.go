@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freePort finds a port nothing is listening on
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestMainStartsWithDefaultFlags runs main in a child process without any of
+// the optional listener flags and checks the proxy comes up
+func TestMainStartsWithDefaultFlags(t *testing.T) {
+	if os.Getenv("PROXY_TEST_MAIN") != "" {
+		os.Args = []string{"proxy-the-proxy", "-proxy", os.Getenv("PROXY_TEST_PROXY_PORT"), "-mgmt", os.Getenv("PROXY_TEST_MGMT_PORT")}
+		main()
+		return
+	}
+	proxyPort := freePort(t)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainStartsWithDefaultFlags$")
+	cmd.Env = append(os.Environ(),
+		"PROXY_TEST_MAIN=1",
+		"PROXY_TEST_PROXY_PORT="+strconv.Itoa(proxyPort),
+		"PROXY_TEST_MGMT_PORT="+strconv.Itoa(freePort(t)),
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Error starting main: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		cmd.Process.Kill()
+		<-exited
+	}()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyPort))
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			exited <- err
+			t.Fatalf("main exited before the proxy was listening: %v", err)
+		default:
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("The proxy did not start listening on %v", addr)
+}
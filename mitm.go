@@ -0,0 +1,318 @@
+package main
+
+/*
+ * TLS interception for CONNECT tunnels, the client has to trust the local CA
+ * which is created the first time interception is turned on
+ */
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	mitmCAValidity   = 10 * 365 * 24 * time.Hour
+	mitmLeafValidity = 30 * 24 * time.Hour
+	// leaves are made again when they have less than this left
+	mitmLeafRenewBefore = 24 * time.Hour
+	// most leaves kept, the least recently used go first
+	mitmMaxLeaves = 1000
+)
+
+var mitmTunnels = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "proxy_mitm_tunnels",
+	Help: "Total CONNECT tunnels which have been intercepted",
+})
+
+// mitmCA signs leaf certificates for intercepted hosts, up to maxLeaves are
+// cached by name so clients can't use up memory with lots of names
+type mitmCA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	// all the leaves share one key, making a new key per host is slow
+	leafKey   *ecdsa.PrivateKey
+	mu        sync.Mutex
+	maxLeaves int
+	leaves    map[string]*list.Element
+	// order has the cachedLeaf for each name, most recently used first
+	order *list.List
+}
+
+type cachedLeaf struct {
+	name string
+	cert *tls.Certificate
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// LoadOrCreateCA loads ca.crt and ca.key from dir, making them if they don't exist yet
+func LoadOrCreateCA(dir string) (*mitmCA, error) {
+	certPath := filepath.Join(dir, "ca.crt")
+	keyPath := filepath.Join(dir, "ca.key")
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf(`LoadOrCreateCA: no CA in %v, creating one`, dir)
+		if err := createCA(dir, certPath, keyPath); err != nil {
+			return nil, err
+		}
+		certPEM, err = os.ReadFile(certPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot be used for signing")
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf(`LoadOrCreateCA: using CA %v from %v, it needs to be trusted by clients`, cert.Subject.CommonName, certPath)
+	return &mitmCA{
+		cert:      cert,
+		key:       key,
+		certPEM:   certPEM,
+		leafKey:   leafKey,
+		maxLeaves: mitmMaxLeaves,
+		leaves:    map[string]*list.Element{},
+		order:     list.New(),
+	}, nil
+}
+
+func createCA(dir string, certPath string, keyPath string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "proxy-the-proxy local CA " + hostname, Organization: []string{"proxy-the-proxy"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(mitmCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// LeafFor returns a certificate for name signed by the CA
+func (c *mitmCA) LeafFor(name string) (*tls.Certificate, error) {
+	name = normaliseHost(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.leaves[name]; ok {
+		if leaf := e.Value.(*cachedLeaf).cert; time.Until(leaf.Leaf.NotAfter) > mitmLeafRenewBefore {
+			c.order.MoveToFront(e)
+			return leaf, nil
+		}
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(mitmLeafValidity)
+	if notAfter.After(c.cert.NotAfter) {
+		notAfter = c.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &c.leafKey.PublicKey, c.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf(`mitmCA: created certificate for %v`, name)
+	cert := &tls.Certificate{Certificate: [][]byte{der, c.cert.Raw}, PrivateKey: c.leafKey, Leaf: leaf}
+	c.store(name, cert)
+	return cert, nil
+}
+
+// store caches cert for name and drops leaves which are about to expire and
+// the least recently used ones over maxLeaves, c.mu must be held
+func (c *mitmCA) store(name string, cert *tls.Certificate) {
+	if e, ok := c.leaves[name]; ok {
+		c.order.Remove(e)
+	}
+	c.leaves[name] = c.order.PushFront(&cachedLeaf{name, cert})
+	for e := c.order.Back(); e != nil; {
+		prev := e.Prev()
+		leaf := e.Value.(*cachedLeaf)
+		if c.order.Len() > c.maxLeaves || time.Until(leaf.cert.Leaf.NotAfter) <= mitmLeafRenewBefore {
+			c.order.Remove(e)
+			delete(c.leaves, leaf.name)
+		}
+		e = prev
+	}
+}
+
+// interceptor decrypts the CONNECT tunnels for the hosts which match
+type interceptor struct {
+	ca    *mitmCA
+	hosts hostPatterns
+}
+
+func NewInterceptor(ca *mitmCA, hosts hostPatterns) *interceptor {
+	return &interceptor{ca: ca, hosts: hosts}
+}
+
+func (i *interceptor) Intercepts(host string) bool {
+	return i.hosts.Match(host)
+}
+
+// oneConnListener lets an http.Server serve a connection we already have
+type oneConnListener struct {
+	conn net.Conn
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, io.EOF
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// Serve answers the CONNECT itself and then reads the requests out of the
+// tunnel, each one is sent on through the PAC-chosen route for its URL
+func (i *interceptor) Serve(wr http.ResponseWriter, req *http.Request, p *proxy, user string) string {
+	hijacker, ok := wr.(http.Hijacker)
+	if !ok {
+		http.Error(wr, "Hijacking not supported", http.StatusInternalServerError)
+		return ""
+	}
+	client_conn, client_buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf(`interceptor: error after connection hijack: %v`, err)
+		return ""
+	}
+	if _, err := io.WriteString(client_conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		client_conn.Close()
+		return ""
+	}
+	log.Printf(`interceptor: intercepting tunnel to %v for %v`, req.Host, req.RemoteAddr)
+	mitmTunnels.Inc()
+
+	host := req.Host
+	// the ClientHello may already be in the buffer if the client didn't wait for the 200
+	tlsConn := tls.Server(&peekedConn{client_conn, client_buf.Reader}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return i.ca.LeafFor(name)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	server := &http.Server{
+		IdleTimeout: time.Duration(p.tunnelDefaults.Idle),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// always go to the host the tunnel was opened for
+			r.URL.Scheme = "https"
+			r.URL.Host = host
+			rec := NewAccessRecord(r)
+			rec.User = user
+			wr := &loggingWriter{ResponseWriter: w}
+			defer p.accessLog.Finish(rec, wr)
+			log.Printf(`interceptor: %v from %v (user %v) for %v`, r.Method, r.RemoteAddr, user, r.URL)
+			if target := p.serveRequest(wr, r, rec); target != "" {
+				proxyServeTimeHistogram.WithLabelValues(target).Observe(time.Since(rec.Time).Seconds())
+			}
+		}),
+	}
+	var lifetimeTimer *time.Timer
+	if lifetime := time.Duration(p.tunnelDefaults.MaxLifetime); lifetime > 0 {
+		lifetimeTimer = time.AfterFunc(lifetime, func() {
+			server.Close()
+		})
+	}
+	// the connection is tracked until the server has finished with it or hijacked it
+	done := p.conns.Track(server, tlsConn)
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			// stop the timer so it doesn't keep the server around until it fires
+			if lifetimeTimer != nil {
+				lifetimeTimer.Stop()
+			}
+			done()
+		}
+	}
+	go server.Serve(&oneConnListener{conn: tlsConn})
+	return "MITM"
+}
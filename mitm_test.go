@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateCAPersists(t *testing.T) {
+	dir := t.TempDir()
+	first, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	second, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("Error loading CA: %v", err)
+	}
+	if !first.cert.Equal(second.cert) {
+		t.Fatalf("Expected the same CA to be loaded the second time")
+	}
+}
+
+func TestLeafForIsSignedAndCached(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	leaf, err := ca.LeafFor("www.example.com:443")
+	if err != nil {
+		t.Fatalf("Error calling LeafFor: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: roots}); err != nil {
+		t.Fatalf("Leaf does not verify: %v", err)
+	}
+	again, _ := ca.LeafFor("WWW.example.com")
+	if again != leaf {
+		t.Fatalf("Expected the leaf to be cached")
+	}
+	ipLeaf, err := ca.LeafFor("10.1.2.3")
+	if err != nil || len(ipLeaf.Leaf.IPAddresses) != 1 {
+		t.Fatalf("Expected an IP address SAN, got %v, %v", ipLeaf, err)
+	}
+}
+
+func TestLeafCacheIsBounded(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	ca.maxLeaves = 2
+	a, _ := ca.LeafFor("a.example.com")
+	ca.LeafFor("b.example.com")
+	// a is used again so b is the least recently used
+	ca.LeafFor("a.example.com")
+	ca.LeafFor("c.example.com")
+	if len(ca.leaves) != 2 || ca.order.Len() != 2 {
+		t.Fatalf("Expected 2 cached leaves, got %v", len(ca.leaves))
+	}
+	if _, ok := ca.leaves["b.example.com"]; ok {
+		t.Fatalf("Expected the least recently used leaf to be dropped")
+	}
+	if again, _ := ca.LeafFor("a.example.com"); again != a {
+		t.Fatalf("Expected the recently used leaf to still be cached")
+	}
+
+	// a leaf which is about to expire is dropped when another is added
+	ca.maxLeaves = 10
+	old, _ := ca.LeafFor("old.example.com")
+	old.Leaf.NotAfter = time.Now().Add(time.Hour)
+	ca.LeafFor("new.example.com")
+	if _, ok := ca.leaves["old.example.com"]; ok {
+		t.Fatalf("Expected the expiring leaf to be dropped")
+	}
+}
+
+func TestHostPatterns(t *testing.T) {
+	patterns := ParseHostPatterns("api.example.com, *.corp.example.com, .test.org")
+	tests := map[string]bool{
+		"api.example.com:443":   true,
+		"www.example.com":       false,
+		"a.corp.example.com":    true,
+		"corp.example.com":      false,
+		"test.org":              true,
+		"deep.sub.test.org:443": true,
+		"nottest.org":           false,
+	}
+	for host, expected := range tests {
+		if patterns.Match(host) != expected {
+			t.Fatalf("Got Match(%v) = %v, expected %v", host, !expected, expected)
+		}
+	}
+}
+
+func TestServeHTTPInterceptsTunnel(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path=%v", r.URL.Path)
+	}))
+	defer target.Close()
+	upstreamRootCAs = x509.NewCertPool()
+	upstreamRootCAs.AddCert(target.Certificate())
+	defer func() { upstreamRootCAs = nil }()
+
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.mitm = NewInterceptor(ca, ParseHostPatterns("127.0.0.1"))
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Error connecting to proxy: %v", err)
+	}
+	defer conn.Close()
+	host := strings.TrimPrefix(target.URL, "https://")
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v, %v", resp, err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: roots})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Error in TLS handshake with the interceptor: %v", err)
+	}
+	fmt.Fprintf(tlsConn, "GET /hello HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", host)
+	resp, err = http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("Error reading intercepted response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "path=/hello" {
+		t.Fatalf("Got unexpected body = %v", string(body))
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+/*
+ * Negotiate (SPNEGO) over HTTP is RFC 4559 https://www.rfc-editor.org/rfc/rfc4559
+ * only the Kerberos mechanism is offered, tickets come from gokrb5
+ */
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// kerberosConfig says where to find the Kerberos settings and credentials
+// with no keytab the user's credential cache is used
+type kerberosConfig struct {
+	Krb5Conf  string `json:"krb5conf,omitempty"`
+	CCache    string `json:"ccache,omitempty"`
+	Keytab    string `json:"keytab,omitempty"`
+	Principal string `json:"principal,omitempty"`
+	// RequireMutual fails responses which don't carry a mutual authentication token
+	RequireMutual bool `json:"require_mutual,omitempty"`
+}
+
+// negotiator makes and checks the tokens used for Negotiate authentication
+type negotiator interface {
+	// Token returns the token to send to the service
+	Token(spn string) ([]byte, error)
+	// Verify checks the token sent back by the service for mutual authentication
+	Verify(spn string, token []byte) error
+}
+
+// global_negotiator is nil unless Kerberos has been configured
+var global_negotiator negotiator
+
+// ProxySPN is the service principal name for the proxy at address
+func ProxySPN(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return "HTTP/" + strings.ToLower(host)
+}
+
+// NegotiateAuthorization builds the Proxy-Authorization value for the proxy at address
+func NegotiateAuthorization(address string) (string, error) {
+	if global_negotiator == nil {
+		return "", errors.New("kerberos is not configured")
+	}
+	token, err := global_negotiator.Token(ProxySPN(address))
+	if err != nil {
+		return "", err
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(token), nil
+}
+
+// VerifyNegotiate checks the mutual authentication token on a successful response,
+// RFC 4559 lets the proxy leave it out so that is only an error with requireMutual
+func VerifyNegotiate(address string, challenges []authChallenge, requireMutual bool) error {
+	for _, c := range challenges {
+		if c.Scheme != "negotiate" || c.Token == "" {
+			continue
+		}
+		token, err := base64.StdEncoding.DecodeString(c.Token)
+		if err != nil {
+			return err
+		}
+		return global_negotiator.Verify(ProxySPN(address), token)
+	}
+	if requireMutual {
+		return fmt.Errorf("%v did not send a mutual authentication token", address)
+	}
+	log.Printf(`VerifyNegotiate: %v did not send a mutual authentication token`, address)
+	return nil
+}
+
+type kerberosNegotiator struct {
+	conf   kerberosConfig
+	mu     sync.Mutex
+	client *client.Client
+	keys   map[string]types.EncryptionKey
+}
+
+func NewKerberosNegotiator(c kerberosConfig) *kerberosNegotiator {
+	return &kerberosNegotiator{conf: c, keys: map[string]types.EncryptionKey{}}
+}
+
+func (k *kerberosNegotiator) login() (*client.Client, error) {
+	if k.client != nil {
+		return k.client, nil
+	}
+	confPath := k.conf.Krb5Conf
+	if confPath == "" {
+		confPath = os.Getenv("KRB5_CONFIG")
+	}
+	if confPath == "" {
+		confPath = "/etc/krb5.conf"
+	}
+	cfg, err := krb5config.Load(confPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %v: %w", confPath, err)
+	}
+
+	var cl *client.Client
+	if k.conf.Keytab != "" {
+		kt, err := keytab.Load(k.conf.Keytab)
+		if err != nil {
+			return nil, fmt.Errorf("could not load keytab %v: %w", k.conf.Keytab, err)
+		}
+		user, realm, _ := strings.Cut(k.conf.Principal, "@")
+		if realm == "" {
+			realm = cfg.LibDefaults.DefaultRealm
+		}
+		cl = client.NewWithKeytab(user, realm, kt, cfg, client.DisablePAFXFAST(true))
+		if err := cl.Login(); err != nil {
+			return nil, fmt.Errorf("could not log in as %v: %w", k.conf.Principal, err)
+		}
+	} else {
+		ccachePath := k.conf.CCache
+		if ccachePath == "" {
+			ccachePath = strings.TrimPrefix(os.Getenv("KRB5CCNAME"), "FILE:")
+		}
+		if ccachePath == "" {
+			ccachePath = fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+		}
+		ccache, err := credentials.LoadCCache(ccachePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load credential cache %v: %w", ccachePath, err)
+		}
+		cl, err = client.NewFromCCache(ccache, cfg, client.DisablePAFXFAST(true))
+		if err != nil {
+			return nil, fmt.Errorf("could not use credential cache %v: %w", ccachePath, err)
+		}
+	}
+	log.Printf(`kerberosNegotiator: logged in as %v@%v`, cl.Credentials.UserName(), cl.Credentials.Realm())
+	k.client = cl
+	return cl, nil
+}
+
+func (k *kerberosNegotiator) Token(spn string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	cl, err := k.login()
+	if err != nil {
+		return nil, err
+	}
+	tkt, key, err := cl.GetServiceTicket(spn)
+	if err != nil {
+		// the credential cache may have been renewed under us so start again next time
+		k.client = nil
+		return nil, fmt.Errorf("could not get service ticket for %v: %w", spn, err)
+	}
+	krb5Token, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key,
+		[]int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf, gssapi.ContextFlagMutual},
+		[]int{flags.APOptionMutualRequired})
+	if err != nil {
+		return nil, err
+	}
+	mechToken, err := krb5Token.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	token := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: mechToken,
+		},
+	}
+	k.keys[spn] = key
+	return token.Marshal()
+}
+
+func (k *kerberosNegotiator) Verify(spn string, token []byte) error {
+	k.mu.Lock()
+	key, ok := k.keys[spn]
+	k.mu.Unlock()
+	if !ok {
+		return errors.New("no session key to check the response with")
+	}
+	_, negToken, err := spnego.UnmarshalNegToken(token)
+	if err != nil {
+		return err
+	}
+	resp, ok := negToken.(spnego.NegTokenResp)
+	if !ok {
+		return errors.New("expected a NegTokenResp from the proxy")
+	}
+	if resp.State() != spnego.NegStateAcceptCompleted {
+		return errors.New(fmt.Sprintf("proxy did not accept the context, state = %v", resp.State()))
+	}
+	var krb5Token spnego.KRB5Token
+	if err := krb5Token.Unmarshal(resp.ResponseToken); err != nil {
+		return err
+	}
+	if !krb5Token.IsAPRep() {
+		return errors.New("expected an AP-REP from the proxy")
+	}
+	// only the real service can encrypt this with our session key
+	plain, err := crypto.DecryptEncPart(krb5Token.APRep.EncPart, key, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return fmt.Errorf("mutual authentication failed: %w", err)
+	}
+	var part messages.EncAPRepPart
+	return part.Unmarshal(plain)
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/crypto/etype"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// fakeNegotiator stands in for the KDC, the "ticket" is just the SPN
+type fakeNegotiator struct{}
+
+func (f *fakeNegotiator) Token(spn string) ([]byte, error) {
+	return []byte("ticket:" + spn), nil
+}
+
+func (f *fakeNegotiator) Verify(spn string, token []byte) error {
+	if string(token) != "mutual:"+spn {
+		return errors.New("bad mutual token")
+	}
+	return nil
+}
+
+func useFakeNegotiator(t *testing.T) {
+	global_negotiator = &fakeNegotiator{}
+	upstreamAuths = map[string]*upstreamAuth{}
+	t.Cleanup(func() {
+		global_negotiator = nil
+		upstreamAuths = map[string]*upstreamAuth{}
+	})
+}
+
+// startFakeNegotiateProxy runs a proxy which wants a Negotiate token and sends mutual
+// back, an empty mutual leaves the token out
+func startFakeNegotiateProxy(t *testing.T, mutual string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	expected := "Negotiate " + base64.StdEncoding.EncodeToString([]byte("ticket:HTTP/127.0.0.1"))
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if req.Header.Get("Proxy-Authorization") != expected {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Negotiate\r\nContent-Length: 0\r\n\r\n"))
+				continue
+			}
+			if mutual == "" {
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\nProxy-Authenticate: Negotiate " + base64.StdEncoding.EncodeToString([]byte(mutual)) + "\r\n\r\n"))
+			return
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestProxySPN(t *testing.T) {
+	if ProxySPN("Proxy.Corp.Example.com:8080") != "HTTP/proxy.corp.example.com" {
+		t.Fatalf("Got unexpected SPN = %v", ProxySPN("Proxy.Corp.Example.com:8080"))
+	}
+}
+
+func TestConnectUpstreamNegotiate(t *testing.T) {
+	useFakeNegotiator(t)
+	addr := startFakeNegotiateProxy(t, "mutual:HTTP/127.0.0.1")
+	conn, err := ConnectUpstream(route{Type: "PROXY", Address: addr}, "example.com:443")
+	if err != nil {
+		t.Fatalf("Error calling ConnectUpstream: %v", err)
+	}
+	conn.Close()
+}
+
+func TestConnectUpstreamNegotiateBadMutual(t *testing.T) {
+	useFakeNegotiator(t)
+	addr := startFakeNegotiateProxy(t, "mutual:HTTP/someone-else")
+	_, err := ConnectUpstream(route{Type: "PROXY", Address: addr}, "example.com:443")
+	if err == nil {
+		t.Fatalf("Expected ConnectUpstream to fail when mutual authentication fails")
+	}
+}
+
+func TestConnectUpstreamNegotiateMissingMutual(t *testing.T) {
+	useFakeNegotiator(t)
+	conn, err := ConnectUpstream(route{Type: "PROXY", Address: startFakeNegotiateProxy(t, "")}, "example.com:443")
+	if err != nil {
+		t.Fatalf("Expected ConnectUpstream to work when the proxy sends no mutual token: %v", err)
+	}
+	conn.Close()
+
+	global_config = &config{Kerberos: &kerberosConfig{RequireMutual: true}}
+	defer func() { global_config = &config{} }()
+	if conn, err := ConnectUpstream(route{Type: "PROXY", Address: startFakeNegotiateProxy(t, "")}, "example.com:443"); err == nil {
+		conn.Close()
+		t.Fatalf("Expected ConnectUpstream to fail when a mutual token is required")
+	}
+}
+
+const testRealm = "TEST.GOKRB5"
+
+// fakeKDC hands out tickets over TCP to anyone who asks, every key is in keytab
+type fakeKDC struct {
+	keytab *keytab.Keytab
+}
+
+// startFakeKDC runs a KDC for testRealm knowing testuser, krbtgt and
+// HTTP/127.0.0.1, it returns the path of a krb5.conf which uses it
+func startFakeKDC(t *testing.T) (*fakeKDC, string) {
+	kt := keytab.New()
+	for _, principal := range []string{"testuser", "krbtgt/" + testRealm, "HTTP/127.0.0.1"} {
+		if err := kt.AddEntry(principal, testRealm, "password for "+principal, time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+			t.Fatalf("Error adding %v to keytab: %v", principal, err)
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	kdc := &fakeKDC{keytab: kt}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go kdc.serve(conn)
+		}
+	}()
+
+	conf := fmt.Sprintf(`[libdefaults]
+  default_realm = %[1]v
+  dns_lookup_kdc = false
+  dns_lookup_realm = false
+  udp_preference_limit = 1
+  default_tkt_enctypes = aes256-cts-hmac-sha1-96
+  default_tgs_enctypes = aes256-cts-hmac-sha1-96
+  permitted_enctypes = aes256-cts-hmac-sha1-96
+
+[realms]
+  %[1]v = {
+    kdc = %[2]v
+  }
+`, testRealm, listener.Addr())
+	path := filepath.Join(t.TempDir(), "krb5.conf")
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatalf("Error writing krb5.conf: %v", err)
+	}
+	return kdc, path
+}
+
+// userKeytab writes a keytab with only testuser in it
+func (k *fakeKDC) userKeytab(t *testing.T) string {
+	kt := keytab.New()
+	kt.AddEntry("testuser", testRealm, "password for testuser", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	b, err := kt.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling keytab: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "user.keytab")
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("Error writing keytab: %v", err)
+	}
+	return path
+}
+
+// serve answers one request, messages over TCP have a four byte length in front
+func (k *fakeKDC) serve(conn net.Conn) {
+	defer conn.Close()
+	var size uint32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return
+	}
+	req := make([]byte, size)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var rep []byte
+	var asReq messages.ASReq
+	var tgsReq messages.TGSReq
+	if err := asReq.Unmarshal(req); err == nil {
+		rep, err = k.asRep(asReq)
+		if err != nil {
+			return
+		}
+	} else if err := tgsReq.Unmarshal(req); err == nil {
+		rep, err = k.tgsRep(tgsReq)
+		if err != nil {
+			return
+		}
+	} else {
+		return
+	}
+	binary.Write(conn, binary.BigEndian, uint32(len(rep)))
+	conn.Write(rep)
+}
+
+// encPart encrypts the reply part for the client
+func encPart(body messages.KDCReqBody, sessionKey types.EncryptionKey, replyKey types.EncryptionKey, usage uint32, kvno int) (types.EncryptedData, error) {
+	now := time.Now().UTC()
+	part := messages.EncKDCRepPart{
+		Key:       sessionKey,
+		LastReqs:  []messages.LastReq{},
+		Nonce:     body.Nonce,
+		Flags:     types.NewKrbFlags(),
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   now.Add(time.Hour),
+		SRealm:    body.Realm,
+		SName:     body.SName,
+	}
+	b, err := part.Marshal()
+	if err != nil {
+		return types.EncryptedData{}, err
+	}
+	return crypto.GetEncryptedData(b, replyKey, usage, kvno)
+}
+
+func (k *fakeKDC) asRep(req messages.ASReq) ([]byte, error) {
+	now := time.Now().UTC()
+	tgt, sessionKey, err := messages.NewTicket(req.ReqBody.CName, testRealm, req.ReqBody.SName, testRealm, types.NewKrbFlags(), k.keytab, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	userKey, _, err := k.keytab.GetEncryptionKey(req.ReqBody.CName, testRealm, 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encPart(req.ReqBody, sessionKey, userKey, keyusage.AS_REP_ENCPART, 1)
+	if err != nil {
+		return nil, err
+	}
+	rep := messages.ASRep{KDCRepFields: messages.KDCRepFields{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AS_REP,
+		CRealm:  testRealm,
+		CName:   req.ReqBody.CName,
+		Ticket:  tgt,
+		EncPart: enc,
+	}}
+	return rep.Marshal()
+}
+
+func (k *fakeKDC) tgsRep(req messages.TGSReq) ([]byte, error) {
+	// the TGT session key comes from the TGT in the request
+	var apReq messages.APReq
+	for _, pa := range req.PAData {
+		if pa.PADataType == patype.PA_TGS_REQ {
+			if err := apReq.Unmarshal(pa.PADataValue); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := apReq.Ticket.DecryptEncPart(k.keytab, nil); err != nil {
+		return nil, err
+	}
+	cname := apReq.Ticket.DecryptedEncPart.CName
+	now := time.Now().UTC()
+	tkt, sessionKey, err := messages.NewTicket(cname, testRealm, req.ReqBody.SName, testRealm, types.NewKrbFlags(), k.keytab, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encPart(req.ReqBody, sessionKey, apReq.Ticket.DecryptedEncPart.Key, keyusage.TGS_REP_ENCPART_SESSION_KEY, 0)
+	if err != nil {
+		return nil, err
+	}
+	rep := messages.TGSRep{KDCRepFields: messages.KDCRepFields{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_TGS_REP,
+		CRealm:  testRealm,
+		CName:   req.ReqBody.CName,
+		Ticket:  tkt,
+		EncPart: enc,
+	}}
+	return rep.Marshal()
+}
+
+// acceptNegotiate checks a Negotiate token as the proxy would and returns the
+// mutual authentication token, replyKey is used to encrypt the AP-REP if set
+func acceptNegotiate(kt *keytab.Keytab, token []byte, replyKey *types.EncryptionKey) ([]byte, messages.APReq, error) {
+	var init spnego.SPNEGOToken
+	if err := init.Unmarshal(token); err != nil {
+		return nil, messages.APReq{}, err
+	}
+	if !init.Init || len(init.NegTokenInit.MechTypes) == 0 || !init.NegTokenInit.MechTypes[0].Equal(gssapi.OIDKRB5.OID()) {
+		return nil, messages.APReq{}, errors.New("expected a NegTokenInit offering Kerberos")
+	}
+	var mech spnego.KRB5Token
+	if err := mech.Unmarshal(init.NegTokenInit.MechTokenBytes); err != nil {
+		return nil, messages.APReq{}, err
+	}
+	if !mech.IsAPReq() {
+		return nil, messages.APReq{}, errors.New("expected an AP-REQ")
+	}
+	apReq := mech.APReq
+	if ok, err := apReq.Verify(kt, time.Minute, types.HostAddress{}, nil); !ok {
+		return nil, apReq, fmt.Errorf("AP-REQ did not verify: %v", err)
+	}
+
+	key := apReq.Ticket.DecryptedEncPart.Key
+	if replyKey != nil {
+		key = *replyKey
+	}
+	part, err := asn1.Marshal(messages.EncAPRepPart{CTime: apReq.Authenticator.CTime, Cusec: apReq.Authenticator.Cusec})
+	if err != nil {
+		return nil, apReq, err
+	}
+	enc, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(part, asnAppTag.EncAPRepPart), key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, apReq, err
+	}
+	rep, err := asn1.Marshal(messages.APRep{PVNO: iana.PVNO, MsgType: msgtype.KRB_AP_REP, EncPart: enc})
+	if err != nil {
+		return nil, apReq, err
+	}
+	// gokrb5 can't marshal an AP-REP KRB5Token so it is put together here
+	oid, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	mechToken := append(append(oid, 0x02, 0x00), asn1tools.AddASNAppTag(rep, asnAppTag.APREP)...)
+	resp := spnego.NegTokenResp{
+		NegState:      asn1.Enumerated(spnego.NegStateAcceptCompleted),
+		SupportedMech: gssapi.OIDKRB5.OID(),
+		ResponseToken: asn1tools.AddASNAppTag(mechToken, 0),
+	}
+	b, err := resp.Marshal()
+	return b, apReq, err
+}
+
+func newTestKerberosNegotiator(t *testing.T) (*kerberosNegotiator, *fakeKDC) {
+	kdc, conf := startFakeKDC(t)
+	return NewKerberosNegotiator(kerberosConfig{
+		Krb5Conf:  conf,
+		Keytab:    kdc.userKeytab(t),
+		Principal: "testuser@" + testRealm,
+	}), kdc
+}
+
+func TestKerberosNegotiatorMutualAuth(t *testing.T) {
+	k, kdc := newTestKerberosNegotiator(t)
+	token, err := k.Token("HTTP/127.0.0.1")
+	if err != nil {
+		t.Fatalf("Error getting token: %v", err)
+	}
+	mutual, apReq, err := acceptNegotiate(kdc.keytab, token, nil)
+	if err != nil {
+		t.Fatalf("Proxy could not accept the token: %v", err)
+	}
+	if !types.IsFlagSet(&apReq.APOptions, flags.APOptionMutualRequired) {
+		t.Fatalf("Expected the AP-REQ to ask for mutual authentication")
+	}
+	if name := apReq.Ticket.DecryptedEncPart.CName.PrincipalNameString(); name != "testuser" {
+		t.Fatalf("Expected a ticket for testuser, got %v", name)
+	}
+	if err := k.Verify("HTTP/127.0.0.1", mutual); err != nil {
+		t.Fatalf("Error verifying mutual authentication: %v", err)
+	}
+}
+
+func TestKerberosNegotiatorBadMutual(t *testing.T) {
+	k, kdc := newTestKerberosNegotiator(t)
+	token, err := k.Token("HTTP/127.0.0.1")
+	if err != nil {
+		t.Fatalf("Error getting token: %v", err)
+	}
+	// an AP-REP which wasn't made with the session key
+	wrongKey, _ := types.GenerateEncryptionKey(mustEtype(t, etypeID.AES256_CTS_HMAC_SHA1_96))
+	mutual, _, err := acceptNegotiate(kdc.keytab, token, &wrongKey)
+	if err != nil {
+		t.Fatalf("Proxy could not accept the token: %v", err)
+	}
+	if err := k.Verify("HTTP/127.0.0.1", mutual); err == nil {
+		t.Fatalf("Expected an AP-REP with the wrong key to fail")
+	}
+	if err := k.Verify("HTTP/other.example.com", mutual); err == nil {
+		t.Fatalf("Expected a reply for an SPN with no ticket to fail")
+	}
+}
+
+func mustEtype(t *testing.T, id int32) etype.EType {
+	e, err := crypto.GetEtype(id)
+	if err != nil {
+		t.Fatalf("Error getting etype: %v", err)
+	}
+	return e
+}
+
+// startKerberosProxy runs a proxy which checks Kerberos tokens against the
+// fake KDC's keys, the mutual authentication token is only sent with mutual
+func startKerberosProxy(t *testing.T, kdc *fakeKDC, mutual bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			token, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "Negotiate "))
+			if err != nil || len(token) == 0 {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Negotiate\r\nContent-Length: 0\r\n\r\n"))
+				continue
+			}
+			reply, _, err := acceptNegotiate(kdc.keytab, token, nil)
+			if err != nil {
+				conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+				return
+			}
+			if !mutual {
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\nProxy-Authenticate: Negotiate " + base64.StdEncoding.EncodeToString(reply) + "\r\n\r\n"))
+			return
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func useKerberosNegotiator(t *testing.T) *fakeKDC {
+	k, kdc := newTestKerberosNegotiator(t)
+	global_negotiator = k
+	upstreamAuths = map[string]*upstreamAuth{}
+	t.Cleanup(func() {
+		global_negotiator = nil
+		global_config = &config{}
+		upstreamAuths = map[string]*upstreamAuth{}
+	})
+	return kdc
+}
+
+func TestConnectUpstreamKerberos(t *testing.T) {
+	kdc := useKerberosNegotiator(t)
+	conn, err := ConnectUpstream(route{Type: "PROXY", Address: startKerberosProxy(t, kdc, true)}, "example.com:443")
+	if err != nil {
+		t.Fatalf("Error calling ConnectUpstream: %v", err)
+	}
+	conn.Close()
+}
+
+// plenty of proxies never send the mutual token, RFC 4559 says it is optional
+func TestConnectUpstreamKerberosNoMutual(t *testing.T) {
+	kdc := useKerberosNegotiator(t)
+	conn, err := ConnectUpstream(route{Type: "PROXY", Address: startKerberosProxy(t, kdc, false)}, "example.com:443")
+	if err != nil {
+		t.Fatalf("Expected ConnectUpstream to work without a mutual token: %v", err)
+	}
+	conn.Close()
+
+	global_config = &config{Kerberos: &kerberosConfig{RequireMutual: true}}
+	if conn, err := ConnectUpstream(route{Type: "PROXY", Address: startKerberosProxy(t, kdc, false)}, "example.com:443"); err == nil {
+		conn.Close()
+		t.Fatalf("Expected ConnectUpstream to fail without a mutual token when it is required")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+/*
+ * NTLM over HTTP is described in MS-NTHT
+ * https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-ntht/
+ * the messages themselves are built by go-ntlmssp (NTLMv2 only)
+ */
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+// ntlmUser splits the configured user into the user and domain parts
+// the domain can either be set on its own or as DOMAIN\user
+func ntlmUser(cred credential) (string, string, bool) {
+	user, domain, domainNeeded := ntlmssp.GetDomain(cred.Username)
+	if cred.Domain != "" {
+		domain = cred.Domain
+		domainNeeded = true
+	}
+	return user, domain, domainNeeded
+}
+
+// NTLMNegotiate builds the type 1 message which starts the handshake
+func NTLMNegotiate(cred credential) (string, error) {
+	_, domain, _ := ntlmUser(cred)
+	msg, err := ntlmssp.NewNegotiateMessage(domain, "")
+	if err != nil {
+		return "", err
+	}
+	return "NTLM " + base64.StdEncoding.EncodeToString(msg), nil
+}
+
+// NTLMAuthenticate answers the type 2 challenge from the proxy with a type 3 message
+func NTLMAuthenticate(cred credential, c authChallenge) (string, error) {
+	challenge, err := base64.StdEncoding.DecodeString(c.Token)
+	if err != nil {
+		return "", err
+	}
+	user, _, domainNeeded := ntlmUser(cred)
+	msg, err := ntlmssp.ProcessChallenge(challenge, user, cred.Password, domainNeeded)
+	if err != nil {
+		return "", err
+	}
+	return "NTLM " + base64.StdEncoding.EncodeToString(msg), nil
+}
+
+// closeConnBody closes the connection once the response body is done with
+// as NTLM authenticates a connection it is only used for one request
+type closeConnBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *closeConnBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// roundTripNTLM sends a plain HTTP request to the proxy on a single connection,
+// going through the type 1, 2 and 3 messages before sending the real request
+func roundTripNTLM(r route, auth *upstreamAuth, req *http.Request, dial func(ctx context.Context) (net.Conn, error)) (*http.Response, error) {
+	// the body was used up by the request which got the 407
+	req, err := rewindBody(req)
+	if err != nil {
+		log.Printf(`roundTripNTLM: %v`, err)
+		return nil, err
+	}
+	conn, err := dial(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	fail := func(err error) (*http.Response, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	negotiate, err := NTLMNegotiate(auth.cred)
+	if err != nil {
+		return fail(err)
+	}
+	// the body is only sent once the connection is authenticated
+	probe := req.Clone(req.Context())
+	probe.Body = http.NoBody
+	probe.ContentLength = 0
+	probe.Header.Set("Proxy-Authorization", negotiate)
+	if err := probe.WriteProxy(conn); err != nil {
+		return fail(err)
+	}
+	resp, err := http.ReadResponse(br, probe)
+	if err != nil {
+		return fail(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Close {
+		return fail(errors.New("roundTripNTLM: proxy did not continue the NTLM handshake, got " + resp.Status))
+	}
+	var challenge *authChallenge
+	for _, c := range ParseChallenges(resp.Header.Values("Proxy-Authenticate")) {
+		if c.Scheme == "ntlm" && c.Token != "" {
+			challenge = &c
+			break
+		}
+	}
+	if challenge == nil {
+		return fail(errors.New("roundTripNTLM: no NTLM challenge from proxy"))
+	}
+
+	authenticate, err := NTLMAuthenticate(auth.cred, *challenge)
+	if err != nil {
+		return fail(err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Proxy-Authorization", authenticate)
+	if err := req.WriteProxy(conn); err != nil {
+		return fail(err)
+	}
+	resp, err = http.ReadResponse(br, req)
+	if err != nil {
+		return fail(err)
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		log.Printf(`roundTripNTLM: NTLM credentials for %v were rejected`, r)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &upgradedBody{br, conn}
+		return resp, nil
+	}
+	resp.Body = &closeConnBody{resp.Body, conn}
+	return resp, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeNTLMChallenge builds a minimal type 2 message
+func fakeNTLMChallenge() []byte {
+	msg := make([]byte, 48)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	// unicode, NTLM and extended session security
+	binary.LittleEndian.PutUint32(msg[20:], 0x00080201)
+	copy(msg[24:], "12345678")
+	// target info is just the end of list marker
+	binary.LittleEndian.PutUint16(msg[40:], 4)
+	binary.LittleEndian.PutUint16(msg[42:], 4)
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return append(msg, 0, 0, 0, 0)
+}
+
+func ntlmMessageType(header string) uint32 {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "NTLM "))
+	if err != nil || len(data) < 12 || string(data[:8]) != "NTLMSSP\x00" {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(data[8:])
+}
+
+// startFakeNTLMProxy runs a proxy which only lets requests through once the
+// type 1, 2, 3 handshake has happened on the same connection
+func startFakeNTLMProxy(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				challenged := false
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					body, _ := io.ReadAll(req.Body)
+					switch ntlmMessageType(req.Header.Get("Proxy-Authorization")) {
+					case 1:
+						challenged = true
+						conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM " + base64.StdEncoding.EncodeToString(fakeNTLMChallenge()) + "\r\nContent-Length: 0\r\n\r\n"))
+						continue
+					case 3:
+						if challenged {
+							if req.Method == http.MethodConnect {
+								conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+								io.Copy(conn, br)
+								return
+							}
+							// the body is sent back so tests can check it arrived
+							if len(body) == 0 {
+								body = []byte("ok")
+							}
+							conn.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %v\r\n\r\n%s", len(body), body)))
+							continue
+						}
+					}
+					challenged = false
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nProxy-Authenticate: Basic realm=\"test\"\r\nContent-Length: 0\r\n\r\n"))
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func useNTLMCredentials(t *testing.T) {
+	global_config = &config{Credentials: []credential{{Host: "127.0.0.1", Username: `CORP\user`, Password: "pass"}}}
+	upstreamAuths = map[string]*upstreamAuth{}
+	t.Cleanup(func() {
+		global_config = &config{}
+		upstreamAuths = map[string]*upstreamAuth{}
+	})
+}
+
+func TestConnectUpstreamNTLM(t *testing.T) {
+	useNTLMCredentials(t)
+	addr := startFakeNTLMProxy(t)
+	conn, err := ConnectUpstream(route{Type: "PROXY", Address: addr}, "example.com:443")
+	if err != nil {
+		t.Fatalf("Error calling ConnectUpstream: %v", err)
+	}
+	checkEcho(t, conn)
+}
+
+func TestRouteTransportNTLM(t *testing.T) {
+	useNTLMCredentials(t)
+	addr := startFakeNTLMProxy(t)
+	transport := NewRouteTransport(route{Type: "PROXY", Address: addr}, defaultTransportSettings)
+	target, _ := url.Parse("http://example.com/")
+	req := &http.Request{Method: http.MethodGet, URL: target, Header: http.Header{}, Body: http.NoBody}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Error calling RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %v, expected 200", resp.Status)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Fatalf("Got unexpected body = %v", string(body))
+	}
+}
+
+func TestRouteTransportNTLMPost(t *testing.T) {
+	useNTLMCredentials(t)
+	addr := startFakeNTLMProxy(t)
+	transport := NewRouteTransport(route{Type: "PROXY", Address: addr}, defaultTransportSettings)
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("hello"))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Error calling RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("Expected the body to be sent after the handshake, got %v %q", resp.Status, string(body))
+	}
+}
+
+func TestRouteTransportNTLMBodyNotKept(t *testing.T) {
+	useNTLMCredentials(t)
+	addr := startFakeNTLMProxy(t)
+	transport := NewRouteTransport(route{Type: "PROXY", Address: addr}, defaultTransportSettings)
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("hello"))
+	req.GetBody = nil
+	if resp, err := transport.RoundTrip(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("Expected an error when the body cannot be sent again, got %v", resp.Status)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overridePAC is the route of an override which leaves the choice to the PAC
+const overridePAC = "PAC"
+
+// overrideRule sends the requests it matches to Route instead of asking the PAC,
+// Route is a PAC style list like "PROXY lab-proxy:3128; DIRECT" or "PAC", the
+// other fields are matched like the policy rules
+type overrideRule struct {
+	Name    string `json:"name,omitempty"`
+	Hosts   string `json:"hosts,omitempty"`
+	CIDRs   string `json:"cidrs,omitempty"`
+	Ports   string `json:"ports,omitempty"`
+	Schemes string `json:"schemes,omitempty"`
+	Route   string `json:"route"`
+}
+
+// override is a loaded overrideRule and how often it has matched
+type override struct {
+	overrideRule
+	match destinationMatch
+	// routes is nil when the rule defers to the PAC
+	routes      []route
+	matches     int64
+	lastMatched atomic.Value
+}
+
+// overrideStatus is how a rule is shown on the status page
+type overrideStatus struct {
+	overrideRule
+	Matches     int64      `json:"matches"`
+	LastMatched *time.Time `json:"last_matched,omitempty"`
+}
+
+// routeOverrides are ordered rules which are checked before the PAC, the
+// first one which matches decides the route
+type routeOverrides struct {
+	path  string
+	mu    sync.RWMutex
+	rules []*override
+}
+
+func parseOverrides(data []byte) ([]*override, error) {
+	var rules []overrideRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	var overrides []*override
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("override %v", i+1)
+		}
+		match, err := NewDestinationMatch(rule.Hosts, rule.CIDRs, rule.Ports, rule.Schemes)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: %v", rule.Name, err))
+		}
+		o := &override{overrideRule: rule, match: match}
+		if !strings.EqualFold(strings.TrimSpace(rule.Route), overridePAC) {
+			for _, entry := range strings.Split(rule.Route, ";") {
+				if strings.TrimSpace(entry) == "" {
+					continue
+				}
+				r, err := ParseRoute(entry)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("%v: %v", rule.Name, err))
+				}
+				o.routes = append(o.routes, r)
+			}
+			if len(o.routes) == 0 {
+				return nil, errors.New(fmt.Sprintf("%v: no route", rule.Name))
+			}
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+// LoadRouteOverrides reads a JSON list of overrideRule from path
+func LoadRouteOverrides(path string) (*routeOverrides, error) {
+	o := &routeOverrides{path: path}
+	if err := o.Reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Reload reads the file again, the old rules are kept if it can't be loaded
+func (o *routeOverrides) Reload() error {
+	if o == nil {
+		return nil
+	}
+	data, err := os.ReadFile(o.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parseOverrides(data)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.rules = rules
+	o.mu.Unlock()
+	log.Printf(`routeOverrides: loaded %v rules from %v`, len(rules), o.path)
+	return nil
+}
+
+// Lookup finds the routes for u, ok is false when no rule matched or the rule
+// which matched defers to the PAC
+func (o *routeOverrides) Lookup(u url.URL) (routes []route, name string, ok bool) {
+	if o == nil {
+		return nil, "", false
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		// CONNECT requests only have a host
+		scheme = "https"
+	}
+	scheme, host, port := splitDestination(scheme, u.Host)
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for _, rule := range o.rules {
+		// names aren't looked up, CIDRs only match IP addresses here
+		if rule.match.Matches(scheme, host, port, nil, false) {
+			atomic.AddInt64(&rule.matches, 1)
+			rule.lastMatched.Store(time.Now())
+			return rule.routes, rule.Name, rule.routes != nil
+		}
+	}
+	return nil, "", false
+}
+
+func (o *routeOverrides) MarshalJSON() ([]byte, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	status := []overrideStatus{}
+	for _, rule := range o.rules {
+		s := overrideStatus{overrideRule: rule.overrideRule, Matches: atomic.LoadInt64(&rule.matches)}
+		if last, ok := rule.lastMatched.Load().(time.Time); ok {
+			s.LastMatched = &last
+		}
+		status = append(status, s)
+	}
+	return json.Marshal(status)
+}
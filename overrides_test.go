@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testOverrides = `[
+  {"name": "lab pac", "hosts": "pac.lab.example.com", "route": "PAC"},
+  {"name": "lab", "hosts": ".lab.example.com", "route": "PROXY lab-proxy:3128; DIRECT"},
+  {"cidrs": "10.0.0.0/8", "ports": "443", "route": "SOCKS5 socks.example.com:1080"}
+]`
+
+func writeOverrides(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing overrides: %v", err)
+	}
+	return path
+}
+
+func TestRouteOverridesLookup(t *testing.T) {
+	o, err := LoadRouteOverrides(writeOverrides(t, testOverrides))
+	if err != nil {
+		t.Fatalf("Error loading overrides: %v", err)
+	}
+	tests := []struct {
+		url    string
+		routes string
+		name   string
+		ok     bool
+	}{
+		{"http://www.lab.example.com/", "PROXY lab-proxy:3128; DIRECT", "lab", true},
+		{"http://pac.lab.example.com/", "", "lab pac", false},
+		{"//10.1.2.3:443", "SOCKS5 socks.example.com:1080", "override 3", true},
+		{"http://10.1.2.3/", "", "", false},
+		{"http://www.example.com/", "", "", false},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		routes, name, ok := o.Lookup(*u)
+		if ok != test.ok || name != test.name || (ok && RoutesToString(routes) != test.routes) {
+			t.Fatalf("Got %v, %v, %v for %v", RoutesToString(routes), name, ok, test.url)
+		}
+	}
+
+	var status []overrideStatus
+	b, _ := json.Marshal(o)
+	if err := json.Unmarshal(b, &status); err != nil || len(status) != 3 {
+		t.Fatalf("Got unexpected status %v, %v", string(b), err)
+	}
+	if status[1].Matches != 1 || status[1].LastMatched == nil || status[2].Matches != 1 {
+		t.Fatalf("Got unexpected status %v", string(b))
+	}
+}
+
+func TestRouteOverridesReload(t *testing.T) {
+	path := writeOverrides(t, testOverrides)
+	o, err := LoadRouteOverrides(path)
+	if err != nil {
+		t.Fatalf("Error loading overrides: %v", err)
+	}
+	bad := []string{
+		`{"route": "DIRECT"}`,
+		`[{"hosts": "example.com", "route": "TELNET example.com"}]`,
+		`[{"hosts": "example.com", "route": " ; "}]`,
+		`[{"ports": "0", "route": "DIRECT"}]`,
+	}
+	for _, content := range bad {
+		os.WriteFile(path, []byte(content), 0644)
+		if err := o.Reload(); err == nil {
+			t.Fatalf("Expected an error loading %v", content)
+		}
+	}
+	// the rules from before are kept
+	u, _ := url.Parse("http://www.lab.example.com/")
+	if _, name, _ := o.Lookup(*u); name != "lab" {
+		t.Fatalf("Expected the old rules to be kept, got %v", name)
+	}
+}
+
+func TestProxyRoutesUsesOverrides(t *testing.T) {
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.Overrides, _ = LoadRouteOverrides(writeOverrides(t, testOverrides))
+
+	u, _ := url.Parse("http://www.lab.example.com/")
+	rec := &accessRecord{}
+	if routes := p.Routes(*u, rec); RoutesToString(routes) != "PROXY lab-proxy:3128; DIRECT" || rec.Cache != "override" {
+		t.Fatalf("Got %v, %v, expected the override", RoutesToString(routes), rec.Cache)
+	}
+	// without a PAC a rule which defers to it goes direct
+	u, _ = url.Parse("http://pac.lab.example.com/")
+	rec = &accessRecord{}
+	if routes := p.Routes(*u, rec); RoutesToString(routes) != "DIRECT" || rec.Cache != "" {
+		t.Fatalf("Got %v, %v, expected DIRECT", RoutesToString(routes), rec.Cache)
+	}
+
+	b, _ := json.Marshal(p)
+	if !strings.Contains(string(b), `"Overrides":[{"name":"lab pac"`) {
+		t.Fatalf("Expected the overrides on the status page, got %v", string(b))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// pacBypassLocal in the bypass list matches host names without a dot, like Windows does
+const pacBypassLocal = "<local>"
+
+// pacFile generates a PAC script which sends everything to this proxy apart
+// from the hosts in the bypass list, which go direct
+type pacFile struct {
+	// proxyAddr is the proxy listener, an unspecified host is replaced with
+	// the address the PAC was fetched from
+	proxyAddr  string
+	conditions []string
+}
+
+// jsString quotes s for use in the PAC script
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// pacCondition turns one bypass entry into a JavaScript test of host
+func pacCondition(entry string) (string, error) {
+	entry = strings.ToLower(entry)
+	switch {
+	case entry == pacBypassLocal:
+		return "isPlainHostName(host)", nil
+	case strings.Contains(entry, "/"):
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", err
+		}
+		if n.IP.To4() == nil {
+			return "", errors.New(fmt.Sprintf("only IPv4 CIDRs can be used in the PAC, not %v", entry))
+		}
+		return fmt.Sprintf("isInNet(host, %v, %v)", jsString(n.IP.String()), jsString(net.IP(n.Mask).String())), nil
+	case strings.HasPrefix(entry, "*"):
+		return fmt.Sprintf("shExpMatch(host, %v)", jsString(entry)), nil
+	case strings.HasPrefix(entry, "."):
+		return fmt.Sprintf("(host == %v || shExpMatch(host, %v))", jsString(entry[1:]), jsString("*"+entry)), nil
+	}
+	return fmt.Sprintf("host == %v", jsString(strings.Trim(entry, "[]"))), nil
+}
+
+// NewPacFile checks the comma separated bypass list, which can have host
+// patterns, IPv4 CIDRs and <local>
+func NewPacFile(proxyAddr string, bypass string) (*pacFile, error) {
+	p := &pacFile{proxyAddr: proxyAddr}
+	for _, entry := range splitList(bypass) {
+		condition, err := pacCondition(entry)
+		if err != nil {
+			return nil, err
+		}
+		p.conditions = append(p.conditions, condition)
+	}
+	return p, nil
+}
+
+// Script returns the PAC, localAddr is where the request for it arrived
+func (p *pacFile) Script(localAddr string) string {
+	host, port, _ := net.SplitHostPort(p.proxyAddr)
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if local, _, err := net.SplitHostPort(localAddr); err == nil {
+			host = local
+		}
+	}
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, condition := range p.conditions {
+		fmt.Fprintf(&b, "  if (%v) return \"DIRECT\";\n", condition)
+	}
+	fmt.Fprintf(&b, "  return %v;\n}\n", jsString("PROXY "+net.JoinHostPort(host, port)))
+	return b.String()
+}
+
+func (p *pacFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	localAddr := ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr.String()
+	}
+	log.Printf(`pacFile: %v from %v`, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(p.Script(localAddr)))
+}
+
+// IsPacRequest is true for requests to the proxy listener itself for the PAC
+func IsPacRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.URL.Host == "" && (req.URL.Path == "/proxy.pac" || req.URL.Path == "/wpad.dat")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPacFileScript(t *testing.T) {
+	pac, err := NewPacFile("127.0.0.1:8080", "<local>, .internal.example.com,*.corp, 10.0.0.0/8, example.org")
+	if err != nil {
+		t.Fatalf("Error creating PAC file: %v", err)
+	}
+	script := pac.Script("")
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"intranet", "DIRECT"},
+		{"internal.example.com", "DIRECT"},
+		{"wiki.internal.example.com", "DIRECT"},
+		{"build.corp", "DIRECT"},
+		{"10.1.2.3", "DIRECT"},
+		{"example.org", "DIRECT"},
+		{"www.example.org", "PROXY 127.0.0.1:8080"},
+		{"notinternal.example.com", "PROXY 127.0.0.1:8080"},
+		{"192.168.1.1", "PROXY 127.0.0.1:8080"},
+	}
+	for _, test := range tests {
+		got, _ := RunWpadPac(script, "127.0.0.1", "https://"+test.host+"/", test.host)
+		if got != test.want {
+			t.Fatalf("Expected %q for %v, got %q", test.want, test.host, got)
+		}
+	}
+}
+
+func TestPacFileBadBypass(t *testing.T) {
+	for _, bypass := range []string{"10.0.0.0/33", "fd00::/8"} {
+		if _, err := NewPacFile("127.0.0.1:8080", bypass); err == nil {
+			t.Fatalf("Expected an error for %v", bypass)
+		}
+	}
+}
+
+func TestPacFileUnspecifiedAddress(t *testing.T) {
+	pac, _ := NewPacFile("0.0.0.0:3128", "")
+	if script := pac.Script("172.17.0.1:3128"); !strings.Contains(script, `"PROXY 172.17.0.1:3128"`) {
+		t.Fatalf("Expected the local address in the PAC, got %v", script)
+	}
+	if script := pac.Script(""); !strings.Contains(script, `"PROXY 127.0.0.1:3128"`) {
+		t.Fatalf("Expected 127.0.0.1 in the PAC, got %v", script)
+	}
+	pac, _ = NewPacFile("[::]:3128", "")
+	if script := pac.Script("[::1]:3128"); !strings.Contains(script, `"PROXY [::1]:3128"`) {
+		t.Fatalf("Expected the IPv6 local address in the PAC, got %v", script)
+	}
+}
+
+func TestServePacFromProxy(t *testing.T) {
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.pacFile, _ = NewPacFile("0.0.0.0:8080", "<local>")
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	for _, path := range []string{"/proxy.pac", "/wpad.dat"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Error fetching %v: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 for %v, got %v", path, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+			t.Fatalf("Expected the PAC content type, got %v", ct)
+		}
+		host, _, _ := net.SplitHostPort(server.Listener.Addr().String())
+		if !strings.Contains(string(body), `"PROXY `+host+`:8080"`) {
+			t.Fatalf("Expected the proxy address in the PAC, got %v", string(body))
+		}
+	}
+}
+
+func TestIsPacRequest(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		want   bool
+	}{
+		{http.MethodGet, "/proxy.pac", true},
+		{http.MethodHead, "/wpad.dat", true},
+		{http.MethodPost, "/proxy.pac", false},
+		{http.MethodGet, "http://example.com/proxy.pac", false},
+		{http.MethodGet, "/other", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		if got := IsPacRequest(req); got != test.want {
+			t.Fatalf("Expected %v for %v %v, got %v", test.want, test.method, test.target, got)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var destinationsBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_destinations_blocked",
+	Help: "Total requests refused by the destination policy, by the rule which blocked them",
+}, []string{"rule"})
+
+const (
+	// names looked up for the CIDR rules are remembered for this long
+	policyLookupTTL = time.Minute
+	// the cache of looked up names is cleared out once it gets this big
+	policyMaxLookups = 10000
+)
+
+// policyRule allows or blocks the destinations it matches, every field which
+// is set has to match, Hosts are host patterns, CIDRs match IP addresses and
+// host names which resolve into them, Ports can include ranges like
+// "8000-8999" and a CONNECT tunnel has the scheme "https"
+type policyRule struct {
+	Name    string `json:"name,omitempty"`
+	Action  string `json:"action"`
+	Hosts   string `json:"hosts,omitempty"`
+	CIDRs   string `json:"cidrs,omitempty"`
+	Ports   string `json:"ports,omitempty"`
+	Schemes string `json:"schemes,omitempty"`
+}
+
+// policyConfig is the policy section of the config file, the first rule which
+// matches decides and Default ("allow" or "block") is used when none do,
+// with BlockUnresolved names which can't be looked up match the CIDRs of block rules
+type policyConfig struct {
+	Default         string       `json:"default,omitempty"`
+	BlockUnresolved bool         `json:"block_unresolved,omitempty"`
+	Rules           []policyRule `json:"rules"`
+}
+
+type portRange struct {
+	from, to int
+}
+
+func parsePorts(value string) ([]portRange, error) {
+	var ports []portRange
+	for _, entry := range splitList(value) {
+		from, to, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			to = from
+		}
+		f, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil || f < 1 || f > 65535 {
+			return nil, errors.New(fmt.Sprintf("invalid port %v", entry))
+		}
+		t, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || t < f || t > 65535 {
+			return nil, errors.New(fmt.Sprintf("invalid port %v", entry))
+		}
+		ports = append(ports, portRange{f, t})
+	}
+	return ports, nil
+}
+
+// destinationMatch matches a scheme, host and port, empty fields match anything
+type destinationMatch struct {
+	hosts   hostPatterns
+	nets    []*net.IPNet
+	ports   []portRange
+	schemes []string
+}
+
+// NewDestinationMatch parses comma separated host patterns, CIDRs, ports and schemes
+func NewDestinationMatch(hosts string, cidrs string, ports string, schemes string) (destinationMatch, error) {
+	m := destinationMatch{hosts: ParseHostPatterns(hosts)}
+	var err error
+	if m.nets, err = parseCIDRs(cidrs); err != nil {
+		return m, err
+	}
+	if m.ports, err = parsePorts(ports); err != nil {
+		return m, err
+	}
+	for _, scheme := range splitList(schemes) {
+		m.schemes = append(m.schemes, strings.ToLower(scheme))
+	}
+	return m, nil
+}
+
+// compiledRule is a policyRule ready to be matched
+type compiledRule struct {
+	destinationMatch
+	name  string
+	allow bool
+}
+
+func parseAction(action string) (bool, error) {
+	switch strings.ToLower(action) {
+	case "allow":
+		return true, nil
+	case "block":
+		return false, nil
+	}
+	return false, errors.New(fmt.Sprintf("action must be allow or block, not %q", action))
+}
+
+// Matches checks a destination, lookup finds the addresses of a host name for
+// the CIDRs and can be nil if only IP addresses should match them, unresolved
+// is what the CIDRs give for a name which can't be looked up
+func (r *destinationMatch) Matches(scheme string, host string, port int, lookup func() ([]net.IP, error), unresolved bool) bool {
+	if r.hosts != nil && !r.hosts.Match(host) {
+		return false
+	}
+	if r.ports != nil {
+		found := false
+		for _, p := range r.ports {
+			if port >= p.from && port <= p.to {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.schemes != nil {
+		found := false
+		for _, s := range r.schemes {
+			if s == scheme {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	// the CIDRs go last so names are only looked up when everything else matched
+	if r.nets != nil {
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else if lookup != nil {
+			var err error
+			if ips, err = lookup(); err != nil {
+				return unresolved
+			}
+		}
+		found := false
+		for _, ip := range ips {
+			if containsIP(r.nets, ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyLookup is a cached lookup of a name for the CIDR rules
+type policyLookup struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// destinationPolicy decides which destinations clients can reach
+type destinationPolicy struct {
+	rules           []compiledRule
+	defaultAllow    bool
+	blockUnresolved bool
+	mu              sync.Mutex
+	lookups         map[string]policyLookup
+}
+
+func NewDestinationPolicy(c *policyConfig) (*destinationPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	d := &destinationPolicy{defaultAllow: true, blockUnresolved: c.BlockUnresolved, lookups: map[string]policyLookup{}}
+	if c.Default != "" {
+		allow, err := parseAction(c.Default)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("policy default: %v", err))
+		}
+		d.defaultAllow = allow
+	}
+	for i, rule := range c.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %v", i+1)
+		}
+		allow, err := parseAction(rule.Action)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("policy %v: %v", name, err))
+		}
+		match, err := NewDestinationMatch(rule.Hosts, rule.CIDRs, rule.Ports, rule.Schemes)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("policy %v: %v", name, err))
+		}
+		d.rules = append(d.rules, compiledRule{match, name, allow})
+	}
+	log.Printf(`NewDestinationPolicy: %v rules, default allow = %v, block unresolved = %v`, len(d.rules), d.defaultAllow, d.blockUnresolved)
+	return d, nil
+}
+
+// defaultPort is the port used for scheme when the URL doesn't have one
+func defaultPort(scheme string) int {
+	switch scheme {
+	case "https", "wss":
+		return 443
+	}
+	return 80
+}
+
+// splitDestination returns the lower case scheme, the host without its port
+// and the port, which is the default for scheme when host doesn't have one
+func splitDestination(scheme string, host string) (string, string, int) {
+	scheme = strings.ToLower(scheme)
+	port := defaultPort(scheme)
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		if n, err := strconv.Atoi(p); err == nil {
+			port = n
+		}
+	}
+	return scheme, normaliseHost(host), port
+}
+
+// lookup finds the addresses of name with global_resolver, the answer (or the
+// error) is kept for policyLookupTTL so requests don't each wait for DNS
+func (d *destinationPolicy) lookup(name string) ([]net.IP, error) {
+	d.mu.Lock()
+	cached, ok := d.lookups[name]
+	d.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.ips, cached.err
+	}
+	ips, err := global_resolver.LookupIP(context.Background(), name)
+	if err != nil {
+		log.Printf(`destinationPolicy: could not look up %v for the CIDR rules: %v`, name, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.lookups) >= policyMaxLookups {
+		for key, l := range d.lookups {
+			if time.Now().After(l.expires) {
+				delete(d.lookups, key)
+			}
+		}
+		if len(d.lookups) >= policyMaxLookups {
+			d.lookups = map[string]policyLookup{}
+		}
+	}
+	d.lookups[name] = policyLookup{ips, err, time.Now().Add(policyLookupTTL)}
+	return ips, err
+}
+
+// Check says whether a scheme and host (which may have a port) can be
+// reached and the name of the rule which decided, a nil policy allows everything
+func (d *destinationPolicy) Check(scheme string, host string) (bool, string) {
+	if d == nil {
+		return true, ""
+	}
+	scheme, name, port := splitDestination(scheme, host)
+	// a name is looked up once for all the CIDR rules, so one which resolves
+	// into a blocked range is blocked
+	var ips []net.IP
+	var err error
+	looked := false
+	lookup := func() ([]net.IP, error) {
+		if !looked {
+			looked = true
+			ips, err = d.lookup(name)
+		}
+		return ips, err
+	}
+	for i := range d.rules {
+		if d.rules[i].Matches(scheme, name, port, lookup, d.blockUnresolved && !d.rules[i].allow) {
+			return d.rules[i].allow, d.rules[i].name
+		}
+	}
+	return d.defaultAllow, "default"
+}
+
+// CheckRequest applies the policy to the destination of a proxy request
+func (d *destinationPolicy) CheckRequest(req *http.Request) (bool, string) {
+	if req.Method == http.MethodConnect {
+		return d.Check("https", req.Host)
+	}
+	return d.Check(req.URL.Scheme, req.URL.Host)
+}
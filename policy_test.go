@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDestinationPolicyCheck(t *testing.T) {
+	policy, err := NewDestinationPolicy(&policyConfig{
+		Default: "block",
+		Rules: []policyRule{
+			{Name: "telemetry", Action: "block", Hosts: "*.telemetry.example.com"},
+			{Action: "allow", Hosts: ".example.com", Schemes: "https,wss"},
+			{Action: "allow", CIDRs: "10.0.0.0/8", Ports: "80,8000-8999"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error creating policy: %v", err)
+	}
+	tests := []struct {
+		scheme, host string
+		allowed      bool
+		rule         string
+	}{
+		{"https", "eu.telemetry.example.com:443", false, "telemetry"},
+		{"https", "www.example.com", true, "rule 2"},
+		{"HTTPS", "EXAMPLE.COM.", true, "rule 2"},
+		{"http", "www.example.com", false, "default"},
+		{"http", "10.1.2.3", true, "rule 3"},
+		{"http", "10.1.2.3:8443", true, "rule 3"},
+		{"http", "10.1.2.3:9000", false, "default"},
+		{"http", "11.1.2.3:8000", false, "default"},
+	}
+	for _, test := range tests {
+		allowed, rule := policy.Check(test.scheme, test.host)
+		if allowed != test.allowed || rule != test.rule {
+			t.Fatalf("Got %v, %v for %v://%v, want %v, %v", allowed, rule, test.scheme, test.host, test.allowed, test.rule)
+		}
+	}
+
+	var none *destinationPolicy
+	if allowed, _ := none.Check("http", "anything"); !allowed {
+		t.Fatalf("Expected a nil policy to allow everything")
+	}
+}
+
+func TestDestinationPolicyErrors(t *testing.T) {
+	bad := []policyConfig{
+		{Default: "maybe"},
+		{Rules: []policyRule{{Action: "deny"}}},
+		{Rules: []policyRule{{Action: "block", CIDRs: "10.0.0.0/33"}}},
+		{Rules: []policyRule{{Action: "block", Ports: "9000-8000"}}},
+		{Rules: []policyRule{{Action: "block", Ports: "http"}}},
+	}
+	for _, c := range bad {
+		if _, err := NewDestinationPolicy(&c); err == nil {
+			t.Fatalf("Expected an error for %+v", c)
+		}
+	}
+}
+
+func TestDestinationPolicyBlocks(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer target.Close()
+
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.policy, _ = NewDestinationPolicy(&policyConfig{Rules: []policyRule{{Name: "local", Action: "block", CIDRs: "127.0.0.0/8"}}})
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatalf("Error calling Get: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "blocked by the proxy policy (local)") {
+		t.Fatalf("Got %v %v, expected the request to be blocked", resp.StatusCode, string(body))
+	}
+
+	// CONNECT fails before the tunnel is opened
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	if _, err := client.Get(strings.Replace(target.URL, "http:", "https:", 1)); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Fatalf("Expected the CONNECT to be forbidden, got %v", err)
+	}
+}
+
+func TestDestinationPolicyResolvesNamesForCIDRs(t *testing.T) {
+	ns := startFakeNameserver(t, map[string]net.IP{
+		"internal.example.com": net.ParseIP("10.1.2.3"),
+		"public.example.com":   net.ParseIP("192.0.2.1"),
+	})
+	r, _ := NewResolver(&dnsConfig{Servers: []dnsServer{{Nameservers: []string{ns}}}})
+	old := global_resolver
+	global_resolver = r
+	defer func() { global_resolver = old }()
+
+	policy, _ := NewDestinationPolicy(&policyConfig{
+		Rules: []policyRule{{Name: "internal", Action: "block", CIDRs: "10.0.0.0/8"}},
+	})
+	if allowed, rule := policy.Check("https", "internal.example.com:443"); allowed || rule != "internal" {
+		t.Fatalf("Expected a name in the blocked range to be blocked, got %v, %v", allowed, rule)
+	}
+	if allowed, _ := policy.Check("https", "public.example.com"); !allowed {
+		t.Fatalf("Expected a name outside the blocked range to be allowed")
+	}
+	if allowed, _ := policy.Check("https", "missing.example.com"); !allowed {
+		t.Fatalf("Expected a name which can't be looked up not to match the CIDR")
+	}
+}
+
+func TestDestinationPolicyCachesLookups(t *testing.T) {
+	ns := startFakeNameserver(t, map[string]net.IP{"internal.example.com": net.ParseIP("10.1.2.3")})
+	r, _ := NewResolver(&dnsConfig{Servers: []dnsServer{{Nameservers: []string{ns}}}})
+	old := global_resolver
+	global_resolver = r
+	defer func() { global_resolver = old }()
+
+	policy, _ := NewDestinationPolicy(&policyConfig{
+		Rules: []policyRule{{Name: "internal", Action: "block", CIDRs: "10.0.0.0/8"}},
+	})
+	if allowed, _ := policy.Check("https", "internal.example.com"); allowed {
+		t.Fatalf("Expected a name in the blocked range to be blocked")
+	}
+	// the nameserver has gone but the answer is remembered
+	global_resolver, _ = NewResolver(&dnsConfig{Servers: []dnsServer{{Nameservers: []string{startFakeNameserver(t, nil)}}}})
+	if allowed, _ := policy.Check("https", "internal.example.com"); allowed {
+		t.Fatalf("Expected the cached lookup to still block the name")
+	}
+	policy.lookups["internal.example.com"] = policyLookup{expires: time.Now().Add(-time.Second)}
+	if allowed, _ := policy.Check("https", "internal.example.com"); !allowed {
+		t.Fatalf("Expected the name to be looked up again once the cache expired")
+	}
+}
+
+func TestDestinationPolicyBlockUnresolved(t *testing.T) {
+	ns := startFakeNameserver(t, map[string]net.IP{"public.example.com": net.ParseIP("192.0.2.1")})
+	r, _ := NewResolver(&dnsConfig{Servers: []dnsServer{{Nameservers: []string{ns}}}})
+	old := global_resolver
+	global_resolver = r
+	defer func() { global_resolver = old }()
+
+	policy, _ := NewDestinationPolicy(&policyConfig{
+		BlockUnresolved: true,
+		Rules: []policyRule{
+			{Name: "trusted", Action: "allow", CIDRs: "192.168.0.0/16"},
+			{Name: "internal", Action: "block", CIDRs: "10.0.0.0/8"},
+		},
+	})
+	if allowed, rule := policy.Check("https", "missing.example.com"); allowed || rule != "internal" {
+		t.Fatalf("Expected a name which can't be looked up to match the block rule, got %v, %v", allowed, rule)
+	}
+	if allowed, rule := policy.Check("https", "public.example.com"); !allowed || rule != "default" {
+		t.Fatalf("Expected a name outside the blocked range to be allowed, got %v, %v", allowed, rule)
+	}
+}
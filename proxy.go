@@ -15,8 +15,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"regexp"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -96,44 +97,135 @@ type proxy struct {
 	Ip           string
 	SearchDomain []string
 	Detected     bool
-	cache        *cache
+	// Overrides is nil when there is no overrides file
+	Overrides *routeOverrides `json:",omitempty"`
+	// Upstreams is nil when health checks are turned off
+	Upstreams  *upstreamHealth `json:",omitempty"`
+	cache      *cache
+	badProxies *badProxies
+	transports *transportPool
+	// users is nil when clients do not need to authenticate
+	users *clientUsers
+	// acl is nil when any client address may connect
+	acl *clientACL
+	// mitm is nil unless TLS interception is turned on
+	mitm *interceptor
+	// conns are the tunnels which have to be drained on shutdown
+	conns *activeConns
+	// tunnelDefaults are used for routes which have no timeouts in the config
+	tunnelDefaults tunnelTimeouts
+	throttle       *throttle
+	// policy is nil when every destination is allowed
+	policy *destinationPolicy
+	// pacFile is the PAC served for /proxy.pac and /wpad.dat, nil if there isn't one
+	pacFile *pacFile
+	// accessLog is nil when there is no access log
+	accessLog *accessLog
+	// har is nil when capture is not possible
+	har *harRecorder
+	mu  sync.RWMutex
 }
 
 func (p *proxy) UpdateIp(ip string) {
-	p.Ip = ip
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Ip != ip {
+		p.Ip = ip
+		p.transports.Reset()
+	}
 }
 
 func (p *proxy) UpdatePac(pac string, detected bool) {
-	p.Pac = pac
-	p.Detected = detected
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Pac != pac || p.Detected != detected {
+		// the routes may have changed so don't keep connections to the old upstreams
+		p.Pac = pac
+		p.Detected = detected
+		p.transports.Reset()
+	}
+}
+
+// state returns the PAC details which can change while requests are being served
+func (p *proxy) state() (pac string, ip string, detected bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Pac, p.Ip, p.Detected
 }
 
-func NewProxy(pac string, ip string, searchdomain []string, detected bool) *proxy {
-	c := NewCache()
-	return &proxy{pac, ip, searchdomain, detected, c}
+func (p *proxy) tunnelTimeouts(r route) tunnelTimeouts {
+	return global_config.TunnelTimeoutsFor(r, p.tunnelDefaults)
+}
+
+func NewProxy(pac string, ip string, searchdomain []string, detected bool, settings transportSettings) *proxy {
+	// with no limits the throttle only measures throughput
+	t, _ := NewThrottle(nil)
+	return &proxy{
+		Pac:          pac,
+		Ip:           ip,
+		SearchDomain: searchdomain,
+		Detected:     detected,
+		cache:        NewCache(),
+		badProxies:   NewBadProxies(),
+		transports:   NewTransportPool(settings),
+		conns:        NewActiveConns(),
+		throttle:     t,
+		har:          NewHarRecorder(os.TempDir()),
+	}
 }
 
-func transfer(destination io.WriteCloser, source io.ReadCloser) {
-	defer destination.Close()
-	defer source.Close()
-	written, _ := io.Copy(destination, source)
+// transfer copies one direction of a tunnel, when the source finishes only the
+// write half of the destination is closed as the other direction may still be
+// sending, the tunnel is closed if that isn't possible or there was an error
+func transfer(t *tunnel, destination io.Writer, source io.Reader) int64 {
+	written, err := io.Copy(t.options.Flow.Writer(&activityWriter{destination, t}), source)
 	totalBytes.Add(float64(written))
+	if err != nil {
+		t.CloseWithReason(closeError)
+	} else if !closeWrite(destination) {
+		t.CloseWithReason(closeEOF)
+	}
+	return written
 }
 
-func GetUpstreamStatus(status string) (bool, string, string) {
-	e := `HTTP\/1.\d (\d+) (.*)`
-	r := regexp.MustCompile(e)
-	result := r.FindAllStringSubmatch(status, -1)
-	if result == nil {
-		return false, "", ""
-	} else {
-		return true, result[0][1], result[0][2]
+// closeWrite half closes TCP and TLS connections, it returns false for anything else
+func closeWrite(w io.Writer) bool {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite() == nil
+	}
+	return false
+}
+
+// upstreamConnectError is returned when an upstream proxy answers a CONNECT
+// with something other than 2xx, Challenges are its Proxy-Authenticate headers
+type upstreamConnectError struct {
+	Upstream   route
+	StatusCode int
+	Status     string
+	Challenges []string
+}
+
+func (e *upstreamConnectError) Error() string {
+	return fmt.Sprintf("upstream %v refused CONNECT: %v", e.Upstream, e.Status)
+}
+
+// sendConnect writes a CONNECT request for host and reads the response headers,
+// anything the proxy sent after them is left in br
+func sendConnect(conn net.Conn, br *bufio.Reader, host string, authorization string) (*http.Response, error) {
+	connectString := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", host, host)
+	if authorization != "" {
+		connectString += fmt.Sprintf("Proxy-Authorization: %s\r\n", authorization)
 	}
+	connectString += "\r\n"
+	if _, err := io.WriteString(conn, connectString); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
 }
 
-func ConnectUpstream(endpoint string, host string) (net.Conn, error) {
+func ConnectUpstream(r route, host string) (net.Conn, error) {
 	start := time.Now()
-	log.Printf(`ConnectUpstream: connecting to %v for host %v`, endpoint, host)
+	log.Printf(`ConnectUpstream: connecting to %v for host %v`, r, host)
 	/*
 		Trying to start on instrumenting DNS lookups
 		dialer := &net.Dialer{
@@ -141,46 +233,78 @@ func ConnectUpstream(endpoint string, host string) (net.Conn, error) {
 
 			},
 		}*/
-	conn, err := net.DialTimeout("tcp", endpoint, 10*time.Second)
+	conn, err := DialUpstream(r)
 	if err != nil {
 		log.Printf(`ConnectUpstream: error connecting: %v`, err)
 		return nil, err
 	}
-	connectString := fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", host)
-	fmt.Fprintf(conn, connectString)
-	status, err := bufio.NewReader(conn).ReadString('\n')
-	okay, code, message := GetUpstreamStatus(status)
-	if !okay {
-		log.Printf(`ConnectUpstream: did not understand upstream response which was = %v`, status)
-		return nil, errors.New("ConnectUpstream: did not get 2xx okay")
-	} else {
-		duration := time.Since(start)
-		proxyUpstreamTunnelConnect.WithLabelValues(code).Observe(duration.Seconds())
+	br := bufio.NewReader(conn)
+
+	auth := GetUpstreamAuth(r.Address)
+	authorization := ""
+	answered := false
+	if auth != nil {
+		authorization = auth.Preemptive(http.MethodConnect, host)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := sendConnect(conn, br, host, authorization)
 		if err != nil {
-			log.Printf(`ConnectUpstream: error getting status from upstream: %v`, err)
+			log.Printf(`ConnectUpstream: did not understand upstream response: %v`, err)
+			conn.Close()
 			return nil, err
 		}
-		if strings.HasPrefix(code, "2") {
+		code := fmt.Sprint(resp.StatusCode)
+		if resp.StatusCode/100 == 2 && auth != nil {
+			if err := auth.CheckMutual(authorization, resp); err != nil {
+				log.Printf(`ConnectUpstream: mutual authentication with %v failed: %v`, r, err)
+				conn.Close()
+				return nil, err
+			}
+		}
+		if resp.StatusCode/100 == 2 {
+			duration := time.Since(start)
+			proxyUpstreamTunnelConnect.WithLabelValues(code).Observe(duration.Seconds())
 			log.Printf(`ConnectUpstream: got 2xx OK from upstream`)
+			if br.Buffered() > 0 {
+				// the destination has already sent something
+				return &peekedConn{conn, br}, nil
+			}
 			return conn, nil
 		}
-		log.Printf(`ConnectUpstream: did not get 2xx OK, instead got = %v, %v`, code, message)
-		return nil, errors.New("ConnectUpstream: did not get 200 okay")
-	}
-}
-
-func GetProxyAddress(result string) (string, error) {
-	// split string
-	proxies := strings.Split(result, ";")
-	if proxies[0] == "DIRECT" {
-		return "DIRECT", nil
-	} else if strings.HasPrefix(proxies[0], "PROXY") {
-		bits := strings.Split(proxies[0], " ")
-		if len(bits) > 1 {
-			return bits[1], nil
+		if resp.StatusCode == http.StatusProxyAuthRequired && auth != nil && attempt < maxAuthAttempts {
+			authorization, err = auth.Answer(ParseChallenges(resp.Header.Values("Proxy-Authenticate")), answered, http.MethodConnect, host)
+			if err == nil {
+				log.Printf(`ConnectUpstream: answering authentication challenge from %v`, r)
+				answered = true
+				// reuse the connection if the proxy will let us, otherwise start again
+				// NTLM needs the same connection so will fail if the proxy closes it
+				if resp.Close || resp.ContentLength < 0 {
+					conn.Close()
+					conn, err = DialUpstream(r)
+					if err != nil {
+						log.Printf(`ConnectUpstream: error reconnecting: %v`, err)
+						return nil, err
+					}
+					br = bufio.NewReader(conn)
+				} else {
+					io.Copy(io.Discard, resp.Body)
+				}
+				continue
+			}
+			log.Printf(`ConnectUpstream: not answering challenge from %v: %v`, r, err)
+		}
+		duration := time.Since(start)
+		proxyUpstreamTunnelConnect.WithLabelValues(code).Observe(duration.Seconds())
+		log.Printf(`ConnectUpstream: did not get 2xx OK, instead got = %v`, resp.Status)
+		resp.Body.Close()
+		conn.Close()
+		return nil, &upstreamConnectError{
+			Upstream:   r,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Challenges: resp.Header.Values("Proxy-Authenticate"),
 		}
 	}
-	return "", errors.New(fmt.Sprintf("Could not find valid proxy address in %v", result))
 }
 
 func GetUrlHash(url string, ip string) []byte {
@@ -190,8 +314,8 @@ func GetUrlHash(url string, ip string) []byte {
 	return hasher.Sum(nil)
 }
 
-func (p *proxy) LookupProxy(url url.URL) string {
-	result := "DIRECT"
+// LookupProxy runs the PAC for url, cached is true if the answer came from the cache
+func (p *proxy) LookupProxy(url url.URL) (routes []route, cached bool) {
 	log.Printf(`LookupProxy: looking up proxy for %v`, url.String())
 	urlString := url.String()
 	host, port, err := net.SplitHostPort(url.Host)
@@ -208,145 +332,295 @@ func (p *proxy) LookupProxy(url url.URL) string {
 		}
 		log.Printf(`LookupProxy: expanding URL as it was missing the scheme, expanded URL = %v`, urlString)
 	}
-	urlhash := GetUrlHash(urlString, p.Ip)
+	pac, ip, _ := p.state()
+	urlhash := GetUrlHash(urlString, ip)
 	cacheValue, err := p.cache.CheckForVal(urlhash)
 	if err == nil {
 		log.Printf(`LookupProxy: got value from cache = %v`, cacheValue)
-		return string(cacheValue)
+		routes, err := GetProxyRoutes(cacheValue)
+		if err == nil {
+			return routes, true
+		}
 	}
-	result, cacheable := RunWpadPac(p.Pac, p.Ip, urlString, host)
-	proxyaddress, err := GetProxyAddress(result)
+	result, cacheable := RunWpadPac(pac, ip, urlString, host)
+	routes, err = GetProxyRoutes(result)
 	if err != nil {
-		log.Printf(`LookupProxy: see above, error getting proxy address, will go direct`)
-		return "DIRECT"
+		log.Printf(`LookupProxy: error getting proxy routes, will go direct: %v`, err)
+		return []route{directRoute}, false
 	} else {
-		log.Printf(`LookupProxy: returning %v, cacheable = %v`, proxyaddress, cacheable)
+		log.Printf(`LookupProxy: returning %v, cacheable = %v`, RoutesToString(routes), cacheable)
 		if cacheable {
-			p.cache.AddVal(urlhash, []byte(proxyaddress))
+			p.cache.AddVal(urlhash, []byte(RoutesToString(routes)))
 		}
-		return proxyaddress
+		return routes, false
 	}
 }
 
-func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
-	start := time.Now()
-	log.Printf(`ServeHTTP: %v from %v for %v`, req.Method, req.RemoteAddr, req.URL)
+// Routes works out where to send a request for u, the overrides are checked
+// first, then the PAC if one was found, otherwise it goes direct
+func (p *proxy) Routes(u url.URL, rec *accessRecord) []route {
+	if routes, rule, ok := p.Overrides.Lookup(u); ok {
+		log.Printf(`Routes: %v matched %v, using %v`, u.Host, rule, RoutesToString(routes))
+		rec.Cache = "override"
+		return routes
+	}
+	if _, _, detected := p.state(); detected {
+		log.Printf(`Routes: looking up proxy...`)
+		routes, cached := p.LookupProxy(u)
+		rec.CacheResult(cached)
+		return routes
+	}
+	return []route{directRoute}
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rec := NewAccessRecord(req)
+	wr := &loggingWriter{ResponseWriter: w}
+	defer p.accessLog.Finish(rec, wr)
+	if !p.acl.AllowedRequest(req) {
+		clientDenied.Inc()
+		http.Error(wr, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if p.pacFile != nil && IsPacRequest(req) {
+		p.pacFile.ServeHTTP(wr, req)
+		return
+	}
 	totalRequests.Inc()
 
-	target := "DIRECT"
+	if p.users != nil {
+		name, ok := p.users.Authenticate(req)
+		if !ok {
+			log.Printf(`ServeHTTP: %v from %v for %v refused, client did not authenticate`, req.Method, req.RemoteAddr, req.URL)
+			clientAuthFailures.Inc()
+			ChallengeClient(wr)
+			return
+		}
+		rec.User = name
+		clientRequests.WithLabelValues(rec.User).Inc()
+	}
+	log.Printf(`ServeHTTP: %v from %v (user %v) for %v`, req.Method, req.RemoteAddr, rec.User, req.URL)
+
+	if allowed, rule := p.policy.CheckRequest(req); !allowed {
+		log.Printf(`ServeHTTP: %v blocked by policy %v`, rec.Target, rule)
+		destinationsBlocked.WithLabelValues(rule).Inc()
+		http.Error(wr, fmt.Sprintf("Access to %v is blocked by the proxy policy (%v)", rec.Target, rule), http.StatusForbidden)
+		return
+	}
 
+	var target string
 	if req.Method == http.MethodConnect {
-		log.Printf(`ServeHTTP: this is a tunnel request for port = %v`, req.URL.Port())
+		target = p.serveTunnel(wr, req, rec)
+	} else {
+		target = p.serveRequest(wr, req, rec)
+	}
+	if target != "" {
+		duration := time.Since(rec.Time)
+		proxyServeTimeHistogram.WithLabelValues(target).Observe(duration.Seconds())
+	}
+}
 
-		result := "DIRECT"
-		if p.Detected {
-			log.Printf(`ServeHTTP: tunnel: looking up proxy...`)
-			result = p.LookupProxy(*req.URL)
-		}
-		target = result
-
-		endpoint := req.Host
-		var dest_conn *net.Conn
-		if result != "DIRECT" {
-			endpoint = result
-			log.Printf(`ServeHTTP: tunnel, connection to %v will go via %v`, req.URL, endpoint)
-
-			conn, err := ConnectUpstream(endpoint, req.Host)
-			if err != nil {
-				http.Error(wr, "Upstream connection failed", http.StatusInternalServerError)
-				return
-			}
-			dest_conn = &conn
-		} else {
-			log.Printf(`ServeHTTP: going direct for %v`, endpoint)
-			conn, err := net.DialTimeout("tcp", endpoint, 10*time.Second)
-			if err != nil {
-				http.Error(wr, "Upstream connection failed", http.StatusInternalServerError)
-				return
-			}
-			dest_conn = &conn
-		}
+// tunnelClosed returns the OnClose for a tunnel which writes its access record
+func (p *proxy) tunnelClosed(rec *accessRecord, wr *loggingWriter) func(int64, int64, string) {
+	rec.tunnel = true
+	return func(sent int64, received int64, reason string) {
+		rec.BytesIn += sent
+		rec.BytesOut += received
+		rec.CloseReason = reason
+		p.accessLog.Complete(rec, wr)
+	}
+}
 
-		// send downstream status OK
-		wr.WriteHeader(http.StatusOK)
-		// hijack downstream
-		hijacker, ok := wr.(http.Hijacker)
-		if !ok {
-			http.Error(wr, "Hijacking not supported", http.StatusInternalServerError)
-			return
-		}
-		client_conn, _, err := hijacker.Hijack()
+// DialRoutes connects to host through the first of routes which works, routes
+// to proxies which are down or have failed recently are tried last
+func (p *proxy) DialRoutes(routes []route, host string) (net.Conn, route, error) {
+	err := errors.New("no routes")
+	for _, r := range p.badProxies.Order(p.Upstreams.Filter(routes)) {
+		log.Printf(`DialRoutes: trying connection to %v via %v`, host, r)
+		var conn net.Conn
+		conn, err = DialRoute(r, host)
 		if err != nil {
-			log.Printf(`ServeHTTP: Error after connection hijack: %v`, err)
-			http.Error(wr, err.Error(), http.StatusServiceUnavailable)
+			log.Printf(`DialRoutes: connection via %v failed: %v`, r, err)
+			if IsRouteFailure(err) {
+				p.badProxies.MarkBad(r)
+				p.Upstreams.Report(r, err)
+				continue
+			}
+			return nil, r, err
 		}
-		// wire together the connections
-		go transfer(*dest_conn, client_conn)
-		go transfer(client_conn, *dest_conn)
-	} else {
+		p.Upstreams.Report(r, nil)
+		return conn, r, nil
+	}
+	return nil, route{}, err
+}
 
-		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
-			http.Error(wr, `Protocol scheme not supported`, http.StatusBadRequest)
-			log.Printf(`ServeHTTP: protocol scheme %v is not supported`, req.URL.Scheme)
-			return
+// serveTunnel handles a CONNECT request, it returns the route used or "" if it failed
+func (p *proxy) serveTunnel(wr *loggingWriter, req *http.Request, rec *accessRecord) string {
+	log.Printf(`ServeHTTP: this is a tunnel request for port = %v`, req.URL.Port())
+	if p.mitm != nil && p.mitm.Intercepts(req.Host) {
+		rec.Route = p.mitm.Serve(wr, req, p, rec.User)
+		return rec.Route
+	}
+
+	dest_conn, used, err := p.DialRoutes(p.Routes(*req.URL, rec), req.Host)
+	if err != nil {
+		var connectErr *upstreamConnectError
+		if errors.As(err, &connectErr) {
+			rec.UpstreamStatus = connectErr.StatusCode
+			http.Error(wr, fmt.Sprintf("Upstream proxy %v refused the connection: %v", connectErr.Upstream, connectErr.Status), http.StatusBadGateway)
+			return ""
 		}
+		http.Error(wr, "Upstream connection failed", http.StatusInternalServerError)
+		return ""
+	}
+	target := used.String()
+	rec.Route = target
+
+	// hijack downstream before answering so nothing the client has sent is lost
+	client_conn, client_buf, err := wr.Hijack()
+	if err != nil {
+		log.Printf(`ServeHTTP: Error hijacking connection: %v`, err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		dest_conn.Close()
+		return ""
+	}
+	if _, err := io.WriteString(client_conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		log.Printf(`ServeHTTP: Error answering CONNECT from %v: %v`, req.RemoteAddr, err)
+		client_conn.Close()
+		dest_conn.Close()
+		rec.CloseReason = closeError
+		return ""
+	}
+	// anything the client sent after the CONNECT (often a TLS ClientHello) is
+	// already in the buffer and has to go first
+	var client net.Conn = client_conn
+	if client_buf.Reader.Buffered() > 0 {
+		client = &peekedConn{client_conn, client_buf.Reader}
+	}
+	// wire together the connections
+	p.conns.Tunnel(client, dest_conn, tunnelOptions{
+		Name:     fmt.Sprintf("%v to %v via %v", req.RemoteAddr, req.Host, used),
+		Timeouts: p.tunnelTimeouts(used),
+		Flow:     p.throttle.Flow(ClientIP(req), rec.User, req.Host),
+		OnClose:  p.tunnelClosed(rec, wr),
+	})
+	return target
+}
+
+// serveRequest sends a plain HTTP request upstream, it returns the route used or "" if it failed
+func (p *proxy) serveRequest(wr *loggingWriter, req *http.Request, rec *accessRecord) string {
+	user := rec.User
+	rec.CountBody(req)
+	// ws:// and wss:// are sent and looked up as http:// and https://
+	*req.URL = HttpURL(*req.URL)
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		http.Error(wr, `Protocol scheme not supported`, http.StatusBadRequest)
+		log.Printf(`ServeHTTP: protocol scheme %v is not supported`, req.URL.Scheme)
+		return ""
+	}
+	flow := p.throttle.Flow(ClientIP(req), user, req.URL.Host)
+	defer flow.Done()
+	upgrade := ""
+	if IsUpgradeRequest(req) {
+		upgrade = req.Header.Get("Upgrade")
+		log.Printf(`ServeHTTP: client wants to upgrade to %v`, upgrade)
+	}
+
+	routes := p.Routes(*req.URL, rec)
+
+	//http://golang.org/src/pkg/net/http/client.go
+	req.RequestURI = ""
 
+	delHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+
+	if clientIP := ClientIP(req); clientIP != "" {
+		appendHostToXForwardHeader(req.Header, clientIP)
+	}
+
+	capture := p.har.Capture(req, user)
+	capture.Request(req)
+
+	target := ""
+	var used route
+	// the body has to be kept to send the request through another route
+	retryable, err := RetryableBody(req)
+	if err != nil {
+		log.Printf(`ServeHTTP: error reading request body: %v`, err)
+		capture.Finish(err)
+		http.Error(wr, "Error reading request body", http.StatusBadRequest)
+		return ""
+	}
+
+	var resp *http.Response
+	for attempt, r := range p.badProxies.Order(p.Upstreams.Filter(routes)) {
+		if attempt > 0 {
+			if !retryable {
+				log.Printf(`ServeHTTP: not trying %v as the request body is too big to send again`, r)
+				break
+			}
+			req.Body, _ = req.GetBody()
+		}
+		log.Printf(`ServeHTTP: using route %v`, r)
 		client := &http.Client{
-			Transport: &http.Transport{
-				Proxy: func(r *http.Request) (*url.URL, error) {
-					result := "DIRECT"
-					if p.Detected {
-						log.Printf(`ServeHTTP: looking up proxy...`)
-						result = p.LookupProxy(*r.URL)
-					}
-					target = result
-					if result == "DIRECT" {
-						return nil, nil
-					} else {
-						proxyUrl := fmt.Sprintf(`http://%v`, result)
-						proxy, err := url.Parse(proxyUrl)
-						if err != nil {
-							log.Printf(`ServeHTTP: got error while parsing proxy URL %v`, err)
-							return nil, err
-						}
-						log.Printf(`ServeHTTP: using proxy %v`, proxy)
-						return proxy, nil
-					}
-				},
-			},
+			Transport: p.transports.Get(r),
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse
 			},
 		}
 
-		//http://golang.org/src/pkg/net/http/client.go
-		req.RequestURI = ""
-
-		delHopHeaders(req.Header)
-
-		if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-			appendHostToXForwardHeader(req.Header, clientIP)
-		}
-
 		http_start := time.Now()
-		resp, err := client.Do(req)
+		resp, err = client.Do(req)
 		http_duration := time.Since(http_start)
-		proxyUpstreamHttp.WithLabelValues(fmt.Sprint(resp.StatusCode)).Observe(http_duration.Seconds())
-		if err != nil {
-			http.Error(wr, "Server Error", http.StatusInternalServerError)
+		target = r.String()
+		used = r
+		rec.Route = target
+		if err == nil {
+			proxyUpstreamHttp.WithLabelValues(fmt.Sprint(resp.StatusCode)).Observe(http_duration.Seconds())
+			p.Upstreams.Report(r, nil)
+			break
 		}
-		defer resp.Body.Close()
-
-		log.Printf(`ServeHTTP: client %v, remote %v, status %v`, req.RemoteAddr, req.URL, resp.Status)
-
-		delHopHeaders(resp.Header)
+		log.Printf(`ServeHTTP: request via %v failed: %v`, r, err)
+		if !IsRouteFailure(err) {
+			break
+		}
+		p.badProxies.MarkBad(r)
+		p.Upstreams.Report(r, err)
+	}
+	if err != nil {
+		capture.Finish(err)
+		http.Error(wr, "Server Error", http.StatusInternalServerError)
+		return ""
+	}
+	log.Printf(`ServeHTTP: client %v, user %v, remote %v, status %v`, req.RemoteAddr, user, req.URL, resp.Status)
+	capture.Response(resp, used)
+	rec.UpstreamStatus = resp.StatusCode
+
+	if upgrade != "" && resp.StatusCode == http.StatusSwitchingProtocols {
+		capture.Finish(nil)
+		if client_conn, upstream, ok := serveUpgrade(wr, resp); ok {
+			rec.Status = resp.StatusCode
+			// the tunnel outlives this request so it gets its own flow
+			p.conns.Tunnel(client_conn, upstream, tunnelOptions{
+				Name:     fmt.Sprintf("%v upgrade to %v via %v", req.RemoteAddr, req.URL.Host, used),
+				Timeouts: p.tunnelTimeouts(used),
+				Flow:     p.throttle.Flow(ClientIP(req), user, req.URL.Host),
+				OnClose:  p.tunnelClosed(rec, wr),
+			})
+		}
+		return target
+	}
+	defer resp.Body.Close()
 
-		copyHeader(wr.Header(), resp.Header)
-		wr.WriteHeader(resp.StatusCode)
-		written, _ := io.Copy(wr, resp.Body)
-		totalBytes.Add(float64(written))
+	delHopHeaders(resp.Header)
 
-	}
-	duration := time.Since(start)
-	proxyServeTimeHistogram.WithLabelValues(target).Observe(duration.Seconds())
+	copyHeader(wr.Header(), resp.Header)
+	wr.WriteHeader(resp.StatusCode)
+	written, err := io.Copy(flow.Writer(wr), resp.Body)
+	totalBytes.Add(float64(written))
+	capture.Finish(err)
+	return target
 }
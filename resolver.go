@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const defaultDNSTimeout = 5 * time.Second
+
+var dnsLookupTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "proxy_dns_lookup_seconds",
+	Help: "Time taken to look up host names by result",
+}, []string{"result"})
+
+// dnsServer says how to look up names ending in Suffix, an empty Suffix is
+// used for every other name, either Nameservers (host or host:port) or the
+// URL of a DNS-over-HTTPS server in DoH should be set
+type dnsServer struct {
+	Suffix      string   `json:"suffix,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+	DoH         string   `json:"doh,omitempty"`
+}
+
+// dnsConfig is the dns section of the config file
+type dnsConfig struct {
+	Timeout duration    `json:"timeout,omitempty"`
+	Servers []dnsServer `json:"servers"`
+}
+
+// resolverGroup are the resolvers for one suffix, tried in order
+type resolverGroup struct {
+	suffix    string
+	resolvers []*net.Resolver
+}
+
+// resolver looks up names for direct connections and the PAC, names which
+// don't match any suffix use the system resolver
+type resolver struct {
+	timeout time.Duration
+	groups  []resolverGroup
+}
+
+var global_resolver = &resolver{timeout: defaultDNSTimeout}
+
+// nameserverResolver sends every query to address
+func nameserverResolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// dohResolver sends every query to a DNS-over-HTTPS server, the Go resolver
+// thinks it is talking DNS over TCP to a dohConn
+func dohResolver(endpoint string) *net.Resolver {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: upstreamRootCAs}}}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, endpoint: endpoint}, nil
+		},
+	}
+}
+
+func NewResolver(c *dnsConfig) (*resolver, error) {
+	r := &resolver{timeout: defaultDNSTimeout}
+	if c == nil {
+		return r, nil
+	}
+	if c.Timeout > 0 {
+		r.timeout = time.Duration(c.Timeout)
+	}
+	for _, server := range c.Servers {
+		group := resolverGroup{suffix: strings.Trim(strings.ToLower(server.Suffix), ".")}
+		for _, ns := range server.Nameservers {
+			if _, _, err := net.SplitHostPort(ns); err != nil {
+				ns = net.JoinHostPort(strings.Trim(ns, "[]"), "53")
+			}
+			group.resolvers = append(group.resolvers, nameserverResolver(ns))
+		}
+		if server.DoH != "" {
+			u, err := url.Parse(server.DoH)
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				return nil, errors.New(fmt.Sprintf("invalid DNS-over-HTTPS URL %v", server.DoH))
+			}
+			group.resolvers = append(group.resolvers, dohResolver(server.DoH))
+		}
+		if len(group.resolvers) == 0 {
+			return nil, errors.New(fmt.Sprintf("no nameservers or doh for suffix %q", server.Suffix))
+		}
+		r.groups = append(r.groups, group)
+	}
+	// the longest suffix wins
+	sort.SliceStable(r.groups, func(i, j int) bool { return len(r.groups[i].suffix) > len(r.groups[j].suffix) })
+	return r, nil
+}
+
+// resolversFor returns the resolvers to try for host
+func (r *resolver) resolversFor(host string) []*net.Resolver {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, group := range r.groups {
+		if group.suffix == "" || host == group.suffix || strings.HasSuffix(host, "."+group.suffix) {
+			return group.resolvers
+		}
+	}
+	return []*net.Resolver{net.DefaultResolver}
+}
+
+// LookupIP finds the addresses of host, each resolver for it is tried until
+// one answers or says the name does not exist
+func (r *resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var err error
+	for _, res := range r.resolversFor(host) {
+		var addrs []net.IPAddr
+		addrs, err = res.LookupIPAddr(ctx, host)
+		if err == nil {
+			dnsLookupTime.WithLabelValues("ok").Observe(time.Since(start).Seconds())
+			ips := []net.IP{}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+			return ips, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			break
+		}
+		log.Printf(`resolver: error looking up %v, trying the next server: %v`, host, err)
+	}
+	result := "error"
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		result = "notfound"
+	}
+	dnsLookupTime.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return nil, err
+}
+
+// DialContext connects to addr trying each of its addresses in turn
+func (r *resolver) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var dialer net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Dial connects to addr, timeout covers looking up the name as well
+func (r *resolver) Dial(network string, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return r.DialContext(ctx, network, addr)
+}
+
+// dohConn turns DNS over TCP messages (which have a two byte length in front)
+// into DNS-over-HTTPS requests
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	endpoint string
+	mu       sync.Mutex
+	in       bytes.Buffer
+	out      bytes.Buffer
+	deadline time.Time
+}
+
+func (d *dohConn) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.in.Write(p)
+	for d.in.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(d.in.Bytes()))
+		if d.in.Len() < 2+size {
+			break
+		}
+		d.in.Next(2)
+		answer, err := d.exchange(d.in.Next(size))
+		if err != nil {
+			return 0, err
+		}
+		binary.Write(&d.out, binary.BigEndian, uint16(len(answer)))
+		d.out.Write(answer)
+	}
+	return len(p), nil
+}
+
+// exchange sends one query, d.mu must be held
+func (d *dohConn) exchange(query []byte) ([]byte, error) {
+	ctx := d.ctx
+	if !d.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("DNS-over-HTTPS server returned %v", resp.Status))
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (d *dohConn) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return d.out.Read(p)
+}
+
+func (d *dohConn) Close() error {
+	return nil
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+func (d *dohConn) LocalAddr() net.Addr  { return dohAddr("") }
+func (d *dohConn) RemoteAddr() net.Addr { return dohAddr(d.endpoint) }
+
+func (d *dohConn) SetDeadline(t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadline = t
+	return nil
+}
+
+func (d *dohConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (d *dohConn) SetWriteDeadline(t time.Time) error {
+	return d.SetDeadline(t)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDNSAnswer answers A queries for names, other names get NXDOMAIN
+func fakeDNSAnswer(query []byte, names map[string]net.IP) []byte {
+	// read the name from the question which follows the 12 byte header
+	labels := []string{}
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		labels = append(labels, string(query[i+1:i+1+int(query[i])]))
+		i += 1 + int(query[i])
+	}
+	end := i + 5
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	ip, found := names[strings.ToLower(strings.Join(labels, "."))]
+
+	answer := append([]byte{}, query[:end]...)
+	// a response, recursion available, no answers yet
+	answer[2], answer[3] = 0x81, 0x80
+	answer[6], answer[7] = 0, 0
+	answer[8], answer[9], answer[10], answer[11] = 0, 0, 0, 0
+	if !found {
+		answer[3] |= 3
+		return answer
+	}
+	if qtype == 1 {
+		answer[7] = 1
+		answer = append(answer, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		answer = append(answer, ip.To4()...)
+	}
+	return answer
+}
+
+func startFakeNameserver(t *testing.T, names map[string]net.IP) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(fakeDNSAnswer(buf[:n], names), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestResolverNameserverPerSuffix(t *testing.T) {
+	lab := startFakeNameserver(t, map[string]net.IP{"web.lab.example.com": net.ParseIP("10.1.2.3")})
+	r, err := NewResolver(&dnsConfig{Servers: []dnsServer{
+		{Suffix: "example.com", Nameservers: []string{"127.0.0.1:1"}},
+		{Suffix: ".lab.example.com.", Nameservers: []string{lab}},
+	}})
+	if err != nil {
+		t.Fatalf("Error creating resolver: %v", err)
+	}
+	ips, err := r.LookupIP(context.Background(), "WEB.lab.example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "10.1.2.3" {
+		t.Fatalf("Got %v, %v, expected 10.1.2.3", ips, err)
+	}
+	_, err = r.LookupIP(context.Background(), "missing.lab.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("Got %v, expected not found", err)
+	}
+	// addresses are not looked up
+	if ips, err := r.LookupIP(context.Background(), "192.168.0.1"); err != nil || ips[0].String() != "192.168.0.1" {
+		t.Fatalf("Got %v, %v for an address", ips, err)
+	}
+}
+
+func TestResolverTimeout(t *testing.T) {
+	// this nameserver never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+	r, _ := NewResolver(&dnsConfig{Timeout: duration(200 * time.Millisecond), Servers: []dnsServer{{Nameservers: []string{conn.LocalAddr().String()}}}})
+	start := time.Now()
+	if _, err := r.LookupIP(context.Background(), "slow.example.com"); err == nil {
+		t.Fatalf("Expected the lookup to fail")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("Lookup took %v, expected it to time out after 200ms", took)
+	}
+}
+
+func TestResolverDoH(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(fakeDNSAnswer(query, map[string]net.IP{"internal.example.com": net.ParseIP("10.9.8.7")}))
+	}))
+	defer server.Close()
+	upstreamRootCAs = x509.NewCertPool()
+	upstreamRootCAs.AddCert(server.Certificate())
+	defer func() { upstreamRootCAs = nil }()
+
+	r, err := NewResolver(&dnsConfig{Servers: []dnsServer{{DoH: server.URL + "/dns-query"}}})
+	if err != nil {
+		t.Fatalf("Error creating resolver: %v", err)
+	}
+	ips, err := r.LookupIP(context.Background(), "internal.example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "10.9.8.7" {
+		t.Fatalf("Got %v, %v, expected 10.9.8.7", ips, err)
+	}
+}
+
+func TestResolverUsedForDirectAndPac(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer target.Close()
+	ns := startFakeNameserver(t, map[string]net.IP{"web.lab.example.com": net.ParseIP("127.0.0.1")})
+	r, _ := NewResolver(&dnsConfig{Servers: []dnsServer{{Suffix: "lab.example.com", Nameservers: []string{ns}}}})
+	old := global_resolver
+	global_resolver = r
+	defer func() { global_resolver = old }()
+
+	if got := PerformDNSLookup("web.lab.example.com"); got != "127.0.0.1" {
+		t.Fatalf("Got %v from PerformDNSLookup, expected 127.0.0.1", got)
+	}
+
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	conn, err := DialRoute(directRoute, net.JoinHostPort("web.lab.example.com", port))
+	if err != nil {
+		t.Fatalf("Error dialing direct: %v", err)
+	}
+	conn.Close()
+
+	client := &http.Client{Transport: NewRouteTransport(directRoute, defaultTransportSettings)}
+	resp, err := client.Get("http://web.lab.example.com:" + port + "/")
+	if err != nil {
+		t.Fatalf("Error calling Get: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Fatalf("Got unexpected body %v", string(body))
+	}
+}
+
+func TestResolverConfigErrors(t *testing.T) {
+	bad := []dnsConfig{
+		{Servers: []dnsServer{{Suffix: "example.com"}}},
+		{Servers: []dnsServer{{DoH: "http://dns.example.com/dns-query"}}},
+	}
+	for _, c := range bad {
+		if _, err := NewResolver(&c); err == nil {
+			t.Fatalf("Expected an error for %+v", c)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a proxy which failed is moved to the back of the list for
+// this matches the behaviour of chromium
+const badProxyRetryAfter = 5 * time.Minute
+
+// request bodies up to this size are kept so they can be sent through the next route
+const maxRetryBody = 1 << 20
+
+// default ports used when a PAC entry does not include one
+var defaultRoutePorts = map[string]string{
+	"PROXY":  "80",
+	"HTTPS":  "443",
+	"SOCKS4": "1080",
+	"SOCKS5": "1080",
+}
+
+// route is a single entry from the result of FindProxyForURL
+// e.g. "PROXY proxy.example.com:8080", "SOCKS5 gw:1080" or "DIRECT"
+type route struct {
+	Type    string
+	Address string
+}
+
+var directRoute = route{Type: "DIRECT"}
+
+func (r route) String() string {
+	if r.Type == "DIRECT" {
+		return r.Type
+	}
+	return fmt.Sprintf(`%s %s`, r.Type, r.Address)
+}
+
+func (r route) IsDirect() bool {
+	return r.Type == "DIRECT"
+}
+
+func (r route) IsSocks() bool {
+	return r.Type == "SOCKS4" || r.Type == "SOCKS5"
+}
+
+// ProxyURL returns the URL to give to http.Transport for this route, or nil
+// if the route is direct or goes via SOCKS (which is handled by the dialer)
+func (r route) ProxyURL() *url.URL {
+	switch r.Type {
+	case "PROXY":
+		return &url.URL{Scheme: "http", Host: r.Address}
+	case "HTTPS":
+		return &url.URL{Scheme: "https", Host: r.Address}
+	}
+	return nil
+}
+
+func RoutesToString(routes []route) string {
+	bits := []string{}
+	for _, r := range routes {
+		bits = append(bits, r.String())
+	}
+	return strings.Join(bits, "; ")
+}
+
+// ParseRoute parses a single entry from a PAC result
+// the grammar follows what chromium accepts, so HTTP is a synonym for PROXY
+// and a bare SOCKS means SOCKS version 4
+func ParseRoute(entry string) (route, error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return route{}, errors.New("empty route")
+	}
+	scheme := strings.ToUpper(fields[0])
+	switch scheme {
+	case "DIRECT":
+		return directRoute, nil
+	case "HTTP":
+		scheme = "PROXY"
+	case "SOCKS":
+		scheme = "SOCKS4"
+	case "PROXY", "HTTPS", "SOCKS4", "SOCKS5":
+	default:
+		return route{}, errors.New(fmt.Sprintf("unsupported route type %v", fields[0]))
+	}
+	if len(fields) != 2 {
+		return route{}, errors.New(fmt.Sprintf("expected a single address in %v", entry))
+	}
+	address := fields[1]
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), defaultRoutePorts[scheme])
+	}
+	return route{Type: scheme, Address: address}, nil
+}
+
+func GetProxyRoutes(result string) ([]route, error) {
+	routes := []route{}
+	for _, entry := range strings.Split(result, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		r, err := ParseRoute(entry)
+		if err != nil {
+			log.Printf(`GetProxyRoutes: ignoring entry %v: %v`, entry, err)
+			continue
+		}
+		routes = append(routes, r)
+	}
+	if len(routes) == 0 {
+		return nil, errors.New(fmt.Sprintf("Could not find valid proxy address in %v", result))
+	}
+	return routes, nil
+}
+
+// IsRouteFailure returns true when the error means we could not reach the
+// route at all, so it is safe (and sensible) to try the next one
+func IsRouteFailure(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial" || opErr.Op == "proxyconnect"
+	}
+	return false
+}
+
+// retryBody is a body too big to keep, what was read is sent before the rest
+type retryBody struct {
+	io.Reader
+	io.Closer
+}
+
+// RetryableBody reads a small request body into memory and sets GetBody so the
+// request can be sent through more than one route, it returns false if the
+// body is too big and the request can only be sent once
+func RetryableBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	body := req.Body
+	buf, err := io.ReadAll(io.LimitReader(body, maxRetryBody+1))
+	if err != nil {
+		return false, err
+	}
+	if len(buf) > maxRetryBody {
+		req.Body = &retryBody{io.MultiReader(bytes.NewReader(buf), body), body}
+		return false, nil
+	}
+	body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+// badProxies keeps track of upstream proxies which have recently failed
+type badProxies struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func NewBadProxies() *badProxies {
+	return &badProxies{until: map[string]time.Time{}}
+}
+
+func (b *badProxies) MarkBad(r route) {
+	if r.IsDirect() {
+		return
+	}
+	log.Printf(`MarkBad: marking %v as bad for %v`, r, badProxyRetryAfter)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.until[r.String()] = time.Now().Add(badProxyRetryAfter)
+}
+
+func (b *badProxies) IsBad(r route) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.until[r.String()]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.until, r.String())
+		return false
+	}
+	return true
+}
+
+// Order moves any routes which are marked as bad to the end of the list
+// they are kept as a last resort in case everything else fails as well
+func (b *badProxies) Order(routes []route) []route {
+	good := []route{}
+	bad := []route{}
+	for _, r := range routes {
+		if b.IsBad(r) {
+			bad = append(bad, r)
+		} else {
+			good = append(good, r)
+		}
+	}
+	return append(good, bad...)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetProxyRoutesFallbackList(t *testing.T) {
+	routes, err := GetProxyRoutes("PROXY a:8080; PROXY b:8080; DIRECT")
+	if err != nil {
+		t.Fatalf("Error calling GetProxyRoutes: %v", err)
+	}
+	if len(routes) != 3 {
+		t.Fatalf("Got %v routes, expected 3", len(routes))
+	}
+	if routes[0].String() != "PROXY a:8080" || routes[1].String() != "PROXY b:8080" || !routes[2].IsDirect() {
+		t.Fatalf("Got unexpected routes = %v", RoutesToString(routes))
+	}
+}
+
+func TestGetProxyRoutesSkipsInvalid(t *testing.T) {
+	routes, err := GetProxyRoutes("PROXY; BOGUS x:1; DIRECT")
+	if err != nil {
+		t.Fatalf("Error calling GetProxyRoutes: %v", err)
+	}
+	if RoutesToString(routes) != "DIRECT" {
+		t.Fatalf("Got unexpected routes = %v", RoutesToString(routes))
+	}
+}
+
+func TestGetProxyRoutesNoValidEntries(t *testing.T) {
+	_, err := GetProxyRoutes("")
+	if err == nil {
+		t.Fatalf("Expected an error for an empty result")
+	}
+}
+
+func TestBadProxiesOrder(t *testing.T) {
+	b := NewBadProxies()
+	routes, _ := GetProxyRoutes("PROXY a:8080; PROXY b:8080; DIRECT")
+	b.MarkBad(routes[0])
+	ordered := b.Order(routes)
+	if RoutesToString(ordered) != "PROXY b:8080; DIRECT; PROXY a:8080" {
+		t.Fatalf("Got unexpected order = %v", RoutesToString(ordered))
+	}
+}
+
+func TestBadProxiesNeverMarksDirect(t *testing.T) {
+	b := NewBadProxies()
+	b.MarkBad(directRoute)
+	if b.IsBad(directRoute) {
+		t.Fatalf("DIRECT should never be marked as bad")
+	}
+}
+
+func TestIsRouteFailure(t *testing.T) {
+	err := &net.OpError{Op: "proxyconnect", Err: errors.New("connection refused")}
+	if !IsRouteFailure(err) {
+		t.Fatalf("Expected proxyconnect error to be a route failure")
+	}
+	if IsRouteFailure(errors.New("some other error")) {
+		t.Fatalf("Expected plain error not to be a route failure")
+	}
+}
+
+func TestGetProxyRoutesAllTypes(t *testing.T) {
+	routes, err := GetProxyRoutes("HTTPS proxy:443; SOCKS5 gw:1080; socks old:1081; SOCKS4 v4; HTTP web:3128; DIRECT")
+	if err != nil {
+		t.Fatalf("Error calling GetProxyRoutes: %v", err)
+	}
+	expected := "HTTPS proxy:443; SOCKS5 gw:1080; SOCKS4 old:1081; SOCKS4 v4:1080; PROXY web:3128; DIRECT"
+	if RoutesToString(routes) != expected {
+		t.Fatalf("Got routes = %v, expected %v", RoutesToString(routes), expected)
+	}
+}
+
+func TestRouteProxyURL(t *testing.T) {
+	r, _ := ParseRoute("HTTPS proxy:443")
+	if r.ProxyURL().String() != "https://proxy:443" {
+		t.Fatalf("Got unexpected proxy URL = %v", r.ProxyURL())
+	}
+	r, _ = ParseRoute("SOCKS5 gw:1080")
+	if r.ProxyURL() != nil {
+		t.Fatalf("Expected SOCKS route to have no proxy URL")
+	}
+}
+
+func TestServeHTTPRetriesBodyOnNextRoute(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer target.Close()
+	// nothing listens on the first route
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	dead.Close()
+
+	pac := fmt.Sprintf(`function FindProxyForURL(url, host) { return "PROXY %v; DIRECT"; }`, dead.Addr())
+	p := NewProxy(pac, "127.0.0.1", nil, true, defaultTransportSettings)
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(target.URL, "text/plain", strings.NewReader("hello upstream"))
+	if err != nil {
+		t.Fatalf("Error posting through the proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello upstream" {
+		t.Fatalf("Expected the body through the second route, got %v %q", resp.Status, string(body))
+	}
+}
+
+func TestRetryableBodyTooBig(t *testing.T) {
+	body := strings.Repeat("x", maxRetryBody+10)
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+	retryable, err := RetryableBody(req)
+	if err != nil || retryable {
+		t.Fatalf("Expected a big body not to be retryable, got %v, %v", retryable, err)
+	}
+	got, _ := io.ReadAll(req.Body)
+	if string(got) != body {
+		t.Fatalf("Expected the whole body to still be sent, got %v bytes", len(got))
+	}
+}
+
+// startHTTPSUpstream runs a proxy over TLS and trusts its certificate for HTTPS upstreams
+func startHTTPSUpstream(t *testing.T) route {
+	upstream := httptest.NewUnstartedServer(NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings))
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	// the CA is loaded the way -upstream-ca does it
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600)
+	pool, err := LoadCertPool(path)
+	if err != nil {
+		t.Fatalf("Error loading CA: %v", err)
+	}
+	upstreamProxyRootCAs = pool
+	t.Cleanup(func() { upstreamProxyRootCAs = nil })
+	return route{Type: "HTTPS", Address: upstream.Listener.Addr().String()}
+}
+
+func TestHTTPSUpstreamConnect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello through TLS"))
+	}))
+	defer target.Close()
+	r := startHTTPSUpstream(t)
+
+	conn, err := DialRoute(r, target.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting through the HTTPS upstream: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello through TLS" {
+		t.Fatalf("Got unexpected body %q", string(body))
+	}
+}
+
+func TestHTTPSUpstreamRequest(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello through TLS"))
+	}))
+	defer target.Close()
+	r := startHTTPSUpstream(t)
+
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	resp, err := NewRouteTransport(r, defaultTransportSettings).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Error sending a request through the HTTPS upstream: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello through TLS" {
+		t.Fatalf("Got unexpected body %q", string(body))
+	}
+}
+
+func TestHTTPSUpstreamUntrusted(t *testing.T) {
+	r := startHTTPSUpstream(t)
+	upstreamProxyRootCAs = nil
+	if conn, err := DialUpstream(r); err == nil {
+		conn.Close()
+		t.Fatalf("Expected an HTTPS upstream with an unknown CA to fail")
+	}
+}
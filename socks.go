@@ -0,0 +1,202 @@
+package main
+
+/*
+ * SOCKS4 and SOCKS4a are described here https://www.openssh.com/txt/socks4.protocol
+ * and https://www.openssh.com/txt/socks4a.protocol
+ * SOCKS5 is RFC 1928 https://www.rfc-editor.org/rfc/rfc1928
+ */
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks4Version   = 0x04
+	socks5Version   = 0x05
+	socksCmdConnect = 0x01
+
+	socks4Granted = 0x5a
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded = 0x00
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func splitHostPortNumber(hostport string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", 0, err
+	}
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(portnum), nil
+}
+
+// DialSocks4 connects to host via a SOCKS4 server
+// if the host cannot be resolved locally it falls back to SOCKS4a and lets the server resolve it
+func DialSocks4(r route, host string) (net.Conn, error) {
+	hostname, port, err := splitHostPortNumber(host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", r.Address, upstreamDialTimeout)
+	if err != nil {
+		log.Printf(`DialSocks4: error connecting to %v: %v`, r.Address, err)
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(upstreamDialTimeout))
+
+	req := []byte{socks4Version, socksCmdConnect, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], port)
+	var ip4 net.IP
+	if ips, err := global_resolver.LookupIP(context.Background(), hostname); err == nil {
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				ip4 = ip.To4()
+				break
+			}
+		}
+	}
+	if ip4 != nil {
+		req = append(req, ip4...)
+		req = append(req, 0)
+	} else {
+		log.Printf(`DialSocks4: could not resolve %v locally, using SOCKS4a`, hostname)
+		req = append(req, 0, 0, 0, 1, 0)
+		req = append(req, []byte(hostname)...)
+		req = append(req, 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp[1] != socks4Granted {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("DialSocks4: request rejected by server, code = %#x", resp[1]))
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf(`DialSocks4: connected to %v via %v`, host, r.Address)
+	return conn, nil
+}
+
+// DialSocks5 connects to host via a SOCKS5 server, host names are resolved by the server
+func DialSocks5(r route, host string) (net.Conn, error) {
+	hostname, port, err := splitHostPortNumber(host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", r.Address, upstreamDialTimeout)
+	if err != nil {
+		log.Printf(`DialSocks5: error connecting to %v: %v`, r.Address, err)
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(upstreamDialTimeout))
+	if err := socks5Handshake(conn, hostname, port); err != nil {
+		log.Printf(`DialSocks5: handshake with %v failed: %v`, r.Address, err)
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf(`DialSocks5: connected to %v via %v`, host, r.Address)
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, hostname string, port uint16) error {
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5AuthNone}); err != nil {
+		return err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return err
+	}
+	if method[0] != socks5Version {
+		return errors.New(fmt.Sprintf("unexpected SOCKS version %v", method[0]))
+	}
+	if method[1] == socks5AuthNoAcceptable {
+		return errors.New("no acceptable authentication method")
+	}
+	if method[1] != socks5AuthNone {
+		return errors.New(fmt.Sprintf("server chose unsupported authentication method %#x", method[1]))
+	}
+
+	req := []byte{socks5Version, socksCmdConnect, 0}
+	if ip := net.ParseIP(hostname); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AddrIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AddrIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(hostname) > 255 {
+			return errors.New("host name is too long")
+		}
+		req = append(req, socks5AddrDomain, byte(len(hostname)))
+		req = append(req, []byte(hostname)...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// reply is VER REP RSV ATYP BND.ADDR BND.PORT
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != socks5Succeeded {
+		if msg, ok := socks5Replies[resp[1]]; ok {
+			return errors.New(msg)
+		}
+		return errors.New(fmt.Sprintf("unknown SOCKS reply %#x", resp[1]))
+	}
+	skip := 0
+	switch resp[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return errors.New(fmt.Sprintf("unknown address type %#x in reply", resp[3]))
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
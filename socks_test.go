@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// startFakeSocks runs a single shot SOCKS server which checks the request and then echoes data
+func startFakeSocks(t *testing.T, handshake func(conn net.Conn) error) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := handshake(conn); err != nil {
+			t.Errorf("Fake SOCKS server handshake failed: %v", err)
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+	return listener.Addr().String()
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Error reading echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("Got unexpected echo = %v", string(buf))
+	}
+}
+
+func TestDialSocks4a(t *testing.T) {
+	addr := startFakeSocks(t, func(conn net.Conn) error {
+		req := make([]byte, 9)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return err
+		}
+		expected := []byte{4, 1, 0x01, 0xbb, 0, 0, 0, 1, 0}
+		if !bytes.Equal(req, expected) {
+			t.Errorf("Got request header %v, expected %v", req, expected)
+		}
+		host := make([]byte, len("unresolvable.invalid")+1)
+		if _, err := io.ReadFull(conn, host); err != nil {
+			return err
+		}
+		if string(host) != "unresolvable.invalid\x00" {
+			t.Errorf("Got unexpected host = %q", host)
+		}
+		_, err := conn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+		return err
+	})
+	conn, err := DialSocks4(route{Type: "SOCKS4", Address: addr}, "unresolvable.invalid:443")
+	if err != nil {
+		t.Fatalf("Error calling DialSocks4: %v", err)
+	}
+	checkEcho(t, conn)
+}
+
+func TestDialSocks4Rejected(t *testing.T) {
+	addr := startFakeSocks(t, func(conn net.Conn) error {
+		io.ReadFull(conn, make([]byte, 9))
+		conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+		return nil
+	})
+	_, err := DialSocks4(route{Type: "SOCKS4", Address: addr}, "127.0.0.1:80")
+	if err == nil {
+		t.Fatalf("Expected an error when the request is rejected")
+	}
+}
+
+func TestDialSocks5(t *testing.T) {
+	addr := startFakeSocks(t, func(conn net.Conn) error {
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return err
+		}
+		conn.Write([]byte{5, socks5AuthNone})
+		req := make([]byte, 5+len("example.com")+2)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return err
+		}
+		expected := append([]byte{5, 1, 0, socks5AddrDomain, byte(len("example.com"))}, []byte("example.com")...)
+		expected = append(expected, 0, 80)
+		if !bytes.Equal(req, expected) {
+			t.Errorf("Got request %v, expected %v", req, expected)
+		}
+		_, err := conn.Write([]byte{5, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, 0x1f, 0x90})
+		return err
+	})
+	conn, err := DialSocks5(route{Type: "SOCKS5", Address: addr}, "example.com:80")
+	if err != nil {
+		t.Fatalf("Error calling DialSocks5: %v", err)
+	}
+	checkEcho(t, conn)
+}
+
+func TestDialSocks5Refused(t *testing.T) {
+	addr := startFakeSocks(t, func(conn net.Conn) error {
+		io.ReadFull(conn, make([]byte, 3))
+		conn.Write([]byte{5, socks5AuthNone})
+		io.ReadFull(conn, make([]byte, 10))
+		conn.Write([]byte{5, 0x05, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return nil
+	})
+	_, err := DialSocks5(route{Type: "SOCKS5", Address: addr}, "10.0.0.1:80")
+	if err == nil || err.Error() != "connection refused" {
+		t.Fatalf("Expected connection refused error, got %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+/*
+ * The SOCKS5 listener follows RFC 1928, username and password
+ * authentication is RFC 1929 https://www.rfc-editor.org/rfc/rfc1929
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5AuthPassword = 0x02
+
+	socks5PasswordVersion = 0x01
+
+	socks5GeneralFailure   = 0x01
+	socks5NotAllowed       = 0x02
+	socks5HostUnreachable  = 0x04
+	socks5CmdNotSupported  = 0x07
+	socks5AddrNotSupported = 0x08
+
+	// how long a client has to finish the SOCKS handshake
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// socksError is a failure which is sent back to the client as a reply code
+type socksError struct {
+	reply byte
+	err   error
+}
+
+func (e *socksError) Error() string {
+	return e.err.Error()
+}
+
+// ServeSocks accepts SOCKS5 clients on l and tunnels their connections
+// through the same routes as CONNECT requests
+func (p *proxy) ServeSocks(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveSocksConn(conn)
+	}
+}
+
+// socksAuthenticate chooses the authentication method and returns the user
+func (p *proxy) socksAuthenticate(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", errors.New(fmt.Sprintf("unsupported SOCKS version %v", header[0]))
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	want := byte(socks5AuthNone)
+	if p.users != nil {
+		want = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", errors.New("client did not offer an acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return "", err
+	}
+	if want == socks5AuthNone {
+		return "-", nil
+	}
+
+	// VER ULEN UNAME PLEN PASSWD
+	version := make([]byte, 2)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return "", err
+	}
+	if version[0] != socks5PasswordVersion {
+		return "", errors.New(fmt.Sprintf("unsupported password authentication version %v", version[0]))
+	}
+	user := make([]byte, version[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return "", err
+	}
+	password := make([]byte, size[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	if !p.users.CheckPassword(string(user), string(password)) {
+		clientAuthFailures.Inc()
+		conn.Write([]byte{socks5PasswordVersion, 0x01})
+		return "", errors.New(fmt.Sprintf("wrong password for %v", string(user)))
+	}
+	if _, err := conn.Write([]byte{socks5PasswordVersion, 0x00}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// socksReadRequest reads the CONNECT request and returns host:port
+func socksReadRequest(conn net.Conn) (string, error) {
+	// VER CMD RSV ATYP
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", errors.New(fmt.Sprintf("unsupported SOCKS version %v", header[0]))
+	}
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if header[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", &socksError{socks5AddrNotSupported, errors.New(fmt.Sprintf("unknown address type %#x", header[3]))}
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	if header[1] != socksCmdConnect {
+		return "", &socksError{socks5CmdNotSupported, errors.New(fmt.Sprintf("command %#x is not supported", header[1]))}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// socksReply sends a reply, the bound address is always given as 0.0.0.0:0
+func socksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (p *proxy) serveSocksConn(conn net.Conn) {
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !p.acl.Allowed(net.ParseIP(clientIP)) {
+		log.Printf(`ServeSocks: refusing connection from %v`, conn.RemoteAddr())
+		clientDenied.Inc()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	user, err := p.socksAuthenticate(conn)
+	if err != nil {
+		log.Printf(`ServeSocks: handshake with %v failed: %v`, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	host, err := socksReadRequest(conn)
+	if err != nil {
+		log.Printf(`ServeSocks: bad request from %v: %v`, conn.RemoteAddr(), err)
+		var socksErr *socksError
+		if errors.As(err, &socksErr) {
+			socksReply(conn, socksErr.reply)
+		}
+		conn.Close()
+		return
+	}
+	totalRequests.Inc()
+	if p.users != nil {
+		clientRequests.WithLabelValues(user).Inc()
+	}
+	log.Printf(`ServeSocks: CONNECT from %v (user %v) for %v`, conn.RemoteAddr(), user, host)
+
+	rec := &accessRecord{
+		Time:   time.Now(),
+		Client: clientIP,
+		User:   user,
+		Method: "SOCKS5",
+		Target: host,
+		Proto:  "socks5",
+	}
+	if allowed, rule := p.policy.Check("https", host); !allowed {
+		log.Printf(`ServeSocks: %v blocked by policy %v`, host, rule)
+		destinationsBlocked.WithLabelValues(rule).Inc()
+		socksReply(conn, socks5NotAllowed)
+		conn.Close()
+		rec.Status = http.StatusForbidden
+		p.accessLog.Write(rec)
+		return
+	}
+
+	// the route is looked up in the same way as a CONNECT to host
+	dest_conn, used, err := p.DialRoutes(p.Routes(url.URL{Host: host}, rec), host)
+	if err != nil {
+		log.Printf(`ServeSocks: could not connect to %v: %v`, host, err)
+		reply := byte(socks5GeneralFailure)
+		if IsRouteFailure(err) {
+			reply = socks5HostUnreachable
+		}
+		socksReply(conn, reply)
+		conn.Close()
+		rec.Status = http.StatusBadGateway
+		p.accessLog.Write(rec)
+		return
+	}
+	if err := socksReply(conn, socks5Succeeded); err != nil {
+		conn.Close()
+		dest_conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	rec.Route = used.String()
+	rec.Status = http.StatusOK
+	proxyServeTimeHistogram.WithLabelValues(rec.Route).Observe(time.Since(rec.Time).Seconds())
+	p.conns.Tunnel(conn, dest_conn, tunnelOptions{
+		Name:     fmt.Sprintf("SOCKS5 %v to %v via %v", conn.RemoteAddr(), host, used),
+		Timeouts: p.tunnelTimeouts(used),
+		Flow:     p.throttle.Flow(clientIP, user, host),
+		OnClose:  p.tunnelClosed(rec, &loggingWriter{}),
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func startSocksServer(t *testing.T, p *proxy) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go p.ServeSocks(l)
+	return l.Addr().String()
+}
+
+func TestServeSocks(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer target.Close()
+
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	addr := startSocksServer(t, p)
+
+	// the SOCKS5 client used for upstreams can talk to the listener
+	conn, err := DialSocks5(route{Type: "SOCKS5", Address: addr}, target.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting via SOCKS5: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatalf("Got unexpected body %v", string(body))
+	}
+
+	// only CONNECT is supported
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn2.Close()
+	conn2.Write([]byte{socks5Version, 1, socks5AuthNone})
+	io.ReadFull(conn2, make([]byte, 2))
+	conn2.Write([]byte{socks5Version, 0x02, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 80})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn2, reply); err != nil || reply[1] != socks5CmdNotSupported {
+		t.Fatalf("Got %v, %v, expected command not supported", reply, err)
+	}
+}
+
+func TestServeSocksPassword(t *testing.T) {
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.users, _ = LoadClientUsers(writeClientUsers(t, "me", "secret"))
+	p.policy, _ = NewDestinationPolicy(&policyConfig{Default: "block"})
+	addr := startSocksServer(t, p)
+
+	login := func(user string, password string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		conn.Write([]byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword})
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(conn, method); err != nil || method[1] != socks5AuthPassword {
+			t.Fatalf("Got %v, %v, expected password authentication", method, err)
+		}
+		req := []byte{socks5PasswordVersion, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		conn.Write(req)
+		status := make([]byte, 2)
+		io.ReadFull(conn, status)
+		return conn, status[1]
+	}
+
+	conn, status := login("me", "wrong")
+	conn.Close()
+	if status == 0 {
+		t.Fatalf("Expected the wrong password to be refused")
+	}
+
+	conn, status = login("me", "secret")
+	defer conn.Close()
+	if status != 0 {
+		t.Fatalf("Expected the right password to work, got %v", status)
+	}
+	// the policy blocks everything
+	conn.Write([]byte{socks5Version, socksCmdConnect, 0, socks5AddrDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks5NotAllowed {
+		t.Fatalf("Got %v, %v, expected not allowed", reply, err)
+	}
+
+	// clients which don't offer a password are refused
+	conn3, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn3.Close()
+	conn3.Write([]byte{socks5Version, 1, socks5AuthNone})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn3, method); err != nil || method[1] != socks5AuthNoAcceptable {
+		t.Fatalf("Got %v, %v, expected no acceptable methods", method, err)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// throughput is averaged over this many seconds
+	meterWindow = 10
+	// buckets and meters which no flow holds and haven't been used for this long are dropped
+	throttleStaleAfter = 10 * time.Minute
+	minBurst           = 32 * 1024
+)
+
+var throttledSeconds = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "proxy_throttled_seconds",
+	Help: "Total time spent waiting because of bandwidth limits",
+})
+
+// byteRate is a number of bytes per second, in JSON it can be a number or a
+// string like "512K" or "10MB" where K, M and G are multiples of 1024
+type byteRate float64
+
+func ParseByteRate(s string) (byteRate, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "/S"), "B")
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	value = strings.TrimRight(value, "KMG")
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid rate %v", s))
+	}
+	return byteRate(number * multiplier), nil
+}
+
+func (b *byteRate) UnmarshalJSON(data []byte) error {
+	var number float64
+	if err := json.Unmarshal(data, &number); err == nil {
+		*b = byteRate(number)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseByteRate(s)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
+
+// limitRule limits the bandwidth of one kind of traffic, exactly one of Client
+// (a CIDR or address, each client IP gets its own limit), User (each matching
+// user gets its own limit, "*" for everyone) or Host (a host pattern, all the
+// traffic to matching hosts shares the limit) should be set
+type limitRule struct {
+	Client string   `json:"client,omitempty"`
+	User   string   `json:"user,omitempty"`
+	Host   string   `json:"host,omitempty"`
+	Rate   byteRate `json:"rate"`
+	Burst  byteRate `json:"burst,omitempty"`
+}
+
+// tokenBucket lets rate bytes a second through with bursts of up to burst bytes
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// flows is how many flows hold the bucket, guarded by the throttle's mu
+	flows int
+}
+
+func NewTokenBucket(rate byteRate, burst byteRate) *tokenBucket {
+	b := float64(burst)
+	if b == 0 {
+		b = float64(rate)
+	}
+	if b < minBurst {
+		b = minBurst
+	}
+	return &tokenBucket{rate: float64(rate), burst: b, tokens: b, last: time.Now()}
+}
+
+// Take removes n tokens and says how long to wait before sending them, the
+// bucket can go into debt so large writes are spread out fairly
+func (b *tokenBucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// meter measures throughput over the last meterWindow seconds
+type meter struct {
+	total   int64
+	mu      sync.Mutex
+	seconds [meterWindow]int64
+	counts  [meterWindow]int64
+	used    time.Time
+	// flows is how many flows hold the meter, guarded by the throttle's mu
+	flows int
+}
+
+func (m *meter) Add(n int) {
+	atomic.AddInt64(&m.total, int64(n))
+	now := time.Now()
+	second := now.Unix()
+	slot := second % meterWindow
+	m.mu.Lock()
+	if m.seconds[slot] != second {
+		m.seconds[slot] = second
+		m.counts[slot] = 0
+	}
+	m.counts[slot] += int64(n)
+	m.used = now
+	m.mu.Unlock()
+}
+
+func (m *meter) Rate() float64 {
+	now := time.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sum int64
+	for i, second := range m.seconds {
+		if now-second < meterWindow {
+			sum += m.counts[i]
+		}
+	}
+	return float64(sum) / meterWindow
+}
+
+// throughput is what the management server shows for one client, user or host
+type throughput struct {
+	Name           string  `json:"name"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	TotalBytes     int64   `json:"total_bytes"`
+}
+
+type throttleRule struct {
+	limitRule
+	client *net.IPNet
+	hosts  hostPatterns
+}
+
+// throttle applies the bandwidth limits and measures throughput
+type throttle struct {
+	rules   []throttleRule
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	meters  map[string]*meter
+	pruned  time.Time
+}
+
+func NewThrottle(rules []limitRule) (*throttle, error) {
+	t := &throttle{buckets: map[string]*tokenBucket{}, meters: map[string]*meter{}, pruned: time.Now()}
+	for _, rule := range rules {
+		r := throttleRule{limitRule: rule}
+		set := 0
+		if rule.Client != "" {
+			nets, err := parseCIDRs(rule.Client)
+			if err != nil || len(nets) != 1 {
+				return nil, errors.New(fmt.Sprintf("invalid client %v in limit", rule.Client))
+			}
+			r.client = nets[0]
+			set++
+		}
+		if rule.User != "" {
+			set++
+		}
+		if rule.Host != "" {
+			r.hosts = ParseHostPatterns(rule.Host)
+			set++
+		}
+		if set != 1 {
+			return nil, errors.New("each limit needs exactly one of client, user or host")
+		}
+		if rule.Rate <= 0 {
+			return nil, errors.New(fmt.Sprintf("limit for %v%v%v needs a rate", rule.Client, rule.User, rule.Host))
+		}
+		t.rules = append(t.rules, r)
+	}
+	return t, nil
+}
+
+// prune drops the buckets and meters nobody has used for a while, t.mu must be held
+// anything a flow still holds is kept however long it has been quiet, otherwise
+// a new flow would get a fresh bucket and the old one would go uncounted
+func (t *throttle) prune() {
+	if time.Since(t.pruned) < time.Minute {
+		return
+	}
+	t.pruned = time.Now()
+	for key, m := range t.meters {
+		m.mu.Lock()
+		stale := m.flows == 0 && time.Since(m.used) > throttleStaleAfter
+		m.mu.Unlock()
+		if stale {
+			delete(t.meters, key)
+		}
+	}
+	for key, b := range t.buckets {
+		b.mu.Lock()
+		stale := b.flows == 0 && time.Since(b.last) > throttleStaleAfter
+		b.mu.Unlock()
+		if stale {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+func (t *throttle) bucket(key string, rule throttleRule) *tokenBucket {
+	b, ok := t.buckets[key]
+	if !ok {
+		b = NewTokenBucket(rule.Rate, rule.Burst)
+		t.buckets[key] = b
+	}
+	return b
+}
+
+func (t *throttle) meter(key string) *meter {
+	m, ok := t.meters[key]
+	if !ok {
+		m = &meter{used: time.Now()}
+		t.meters[key] = m
+	}
+	return m
+}
+
+// Flow finds the limits and meters for traffic between a client and a destination host
+// user is "-" when the client has not authenticated, Done has to be called when the traffic ends
+func (t *throttle) Flow(clientIP string, user string, host string) *flow {
+	host = normaliseHost(host)
+	f := &flow{t: t}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune()
+	ip := net.ParseIP(clientIP)
+	var client, named, dest bool
+	for i, rule := range t.rules {
+		switch {
+		case rule.client != nil && !client && ip != nil && rule.client.Contains(ip):
+			client = true
+			f.buckets = append(f.buckets, t.bucket(fmt.Sprintf("%v:client:%v", i, clientIP), rule))
+		case rule.User != "" && !named && user != "-" && (rule.User == "*" || rule.User == user):
+			named = true
+			f.buckets = append(f.buckets, t.bucket(fmt.Sprintf("%v:user:%v", i, user), rule))
+		case rule.hosts != nil && !dest && rule.hosts.Match(host):
+			dest = true
+			f.buckets = append(f.buckets, t.bucket(fmt.Sprintf("%v:host", i), rule))
+		}
+	}
+	f.meters = append(f.meters, t.meter("client:"+clientIP), t.meter("host:"+host))
+	if user != "-" {
+		f.meters = append(f.meters, t.meter("user:"+user))
+	}
+	for _, b := range f.buckets {
+		b.flows++
+	}
+	for _, m := range f.meters {
+		m.flows++
+	}
+	return f
+}
+
+// Throughput lists what each client, user and host is doing, busiest first
+func (t *throttle) Throughput() map[string][]throughput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := map[string][]throughput{"clients": {}, "users": {}, "hosts": {}}
+	for key, m := range t.meters {
+		kind, name, _ := strings.Cut(key, ":")
+		kind += "s"
+		result[kind] = append(result[kind], throughput{Name: name, BytesPerSecond: m.Rate(), TotalBytes: atomic.LoadInt64(&m.total)})
+	}
+	for _, list := range result {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].BytesPerSecond != list[j].BytesPerSecond {
+				return list[i].BytesPerSecond > list[j].BytesPerSecond
+			}
+			return list[i].Name < list[j].Name
+		})
+	}
+	return result
+}
+
+// flow is the set of buckets and meters some traffic goes through
+type flow struct {
+	t       *throttle
+	buckets []*tokenBucket
+	meters  []*meter
+	done    sync.Once
+}
+
+// Done lets the buckets and meters be pruned once nothing else holds them
+func (f *flow) Done() {
+	if f == nil || f.t == nil {
+		return
+	}
+	f.done.Do(func() {
+		f.t.mu.Lock()
+		defer f.t.mu.Unlock()
+		for _, b := range f.buckets {
+			b.flows--
+		}
+		for _, m := range f.meters {
+			m.flows--
+		}
+	})
+}
+
+// Writer wraps w so writes are limited and measured, a nil flow leaves w alone
+func (f *flow) Writer(w io.Writer) io.Writer {
+	if f == nil {
+		return w
+	}
+	return &throttledWriter{w, f}
+}
+
+type throttledWriter struct {
+	w io.Writer
+	f *flow
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var wait time.Duration
+	for _, b := range t.f.buckets {
+		if d := b.Take(len(p)); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		throttledSeconds.Add(wait.Seconds())
+		time.Sleep(wait)
+	}
+	n, err := t.w.Write(p)
+	for _, m := range t.f.meters {
+		m.Add(n)
+	}
+	return n, err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := map[string]byteRate{
+		"100":    100,
+		"512K":   512 * 1024,
+		"10MB":   10 * 1024 * 1024,
+		"1.5m/s": 1.5 * 1024 * 1024,
+		"1G":     1024 * 1024 * 1024,
+	}
+	for s, expected := range tests {
+		got, err := ParseByteRate(s)
+		if err != nil || got != expected {
+			t.Fatalf("Got ParseByteRate(%v) = %v, %v, expected %v", s, got, err, expected)
+		}
+	}
+	if _, err := ParseByteRate("fast"); err == nil {
+		t.Fatalf("Expected an error for an invalid rate")
+	}
+}
+
+func TestThrottledWriterLimitsRate(t *testing.T) {
+	th, err := NewThrottle([]limitRule{{Client: "127.0.0.1", Rate: 256 * 1024, Burst: 32 * 1024}})
+	if err != nil {
+		t.Fatalf("Error calling NewThrottle: %v", err)
+	}
+	var out bytes.Buffer
+	w := th.Flow("127.0.0.1", "-", "example.com").Writer(&out)
+	start := time.Now()
+	chunk := make([]byte, 32*1024)
+	// 160K at 256K/s with a 32K burst should take about half a second
+	for i := 0; i < 5; i++ {
+		w.Write(chunk)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Writes took %v, expected about 500ms", elapsed)
+	}
+	// other clients are not limited
+	start = time.Now()
+	other := th.Flow("127.0.0.2", "-", "example.com").Writer(&out)
+	for i := 0; i < 5; i++ {
+		other.Write(chunk)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("Unlimited client took %v", elapsed)
+	}
+}
+
+func TestThrottleFlowRules(t *testing.T) {
+	th, err := NewThrottle([]limitRule{
+		{User: "alice", Rate: 1000},
+		{Host: "*.docker.io", Rate: 1000},
+		{Client: "10.0.0.0/8", Rate: 1000},
+	})
+	if err != nil {
+		t.Fatalf("Error calling NewThrottle: %v", err)
+	}
+	if f := th.Flow("10.1.1.1", "alice", "registry-1.docker.io:443"); len(f.buckets) != 3 {
+		t.Fatalf("Got %v buckets, expected 3", len(f.buckets))
+	}
+	if f := th.Flow("192.168.1.1", "-", "example.com"); len(f.buckets) != 0 {
+		t.Fatalf("Got %v buckets, expected none", len(f.buckets))
+	}
+	// buckets come in rule order, the host limit is shared and client limits are not
+	a := th.Flow("10.1.1.1", "-", "a.docker.io")
+	b := th.Flow("10.1.1.2", "-", "b.docker.io")
+	if a.buckets[0] != b.buckets[0] || a.buckets[1] == b.buckets[1] {
+		t.Fatalf("Expected separate client buckets and a shared host bucket")
+	}
+	if _, err := NewThrottle([]limitRule{{User: "bob", Host: "x", Rate: 1}}); err == nil {
+		t.Fatalf("Expected an error for a rule with two kinds")
+	}
+}
+
+func TestThrottleThroughput(t *testing.T) {
+	th, _ := NewThrottle(nil)
+	var out bytes.Buffer
+	th.Flow("127.0.0.1", "alice", "example.com:443").Writer(&out).Write(make([]byte, 1000))
+	result := th.Throughput()
+	if len(result["users"]) != 1 || result["users"][0].Name != "alice" || result["users"][0].TotalBytes != 1000 {
+		t.Fatalf("Got unexpected users = %+v", result["users"])
+	}
+	if len(result["hosts"]) != 1 || result["hosts"][0].Name != "example.com" || result["hosts"][0].BytesPerSecond != 100 {
+		t.Fatalf("Got unexpected hosts = %+v", result["hosts"])
+	}
+	if _, err := json.Marshal(result); err != nil {
+		t.Fatalf("Error marshalling throughput: %v", err)
+	}
+}
+
+func TestThrottlePruneKeepsLiveFlows(t *testing.T) {
+	th, _ := NewThrottle([]limitRule{{Client: "127.0.0.0/8", Rate: 1000}})
+	// pretend everything was last used long ago
+	age := func() {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		th.pruned = time.Now().Add(-time.Hour)
+		for _, b := range th.buckets {
+			b.last = time.Now().Add(-time.Hour)
+		}
+		for _, m := range th.meters {
+			m.used = time.Now().Add(-time.Hour)
+		}
+	}
+
+	live := th.Flow("127.0.0.1", "-", "example.com")
+	age()
+	second := th.Flow("127.0.0.1", "-", "example.com")
+	if second.buckets[0] != live.buckets[0] || second.meters[0] != live.meters[0] {
+		t.Fatalf("Expected a flow from the same client to share the bucket and meter of the live flow")
+	}
+
+	live.Done()
+	second.Done()
+	// calling Done twice must not let go of someone else's hold
+	second.Done()
+	age()
+	third := th.Flow("127.0.0.1", "-", "example.com")
+	defer third.Done()
+	if third.buckets[0] == live.buckets[0] {
+		t.Fatalf("Expected the bucket to be pruned once no flow holds it")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// how long to wait for the client to send a TLS ClientHello or HTTP request
+	transparentPeekTimeout = 3 * time.Second
+	// largest TLS record or HTTP request header which is looked at
+	transparentPeekSize = 16*1024 + 5
+)
+
+// originalDestination is replaced in tests which can't use netfilter
+var originalDestination = OriginalDestination
+
+var transparentConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_transparent_connections",
+	Help: "Total connections to the transparent listener by the protocol seen",
+}, []string{"protocol"})
+
+// peekedConn replays the bytes which were peeked before reading the connection
+type peekedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// CloseWrite lets tunnels half-close the client side
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection does not support CloseWrite")
+}
+
+// helloConn lets a tls.Server read a ClientHello and nothing else
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *helloConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+var errGotHello = errors.New("got ClientHello")
+
+// ServerNameFromHello finds the SNI in a TLS ClientHello record
+func ServerNameFromHello(hello []byte) string {
+	var name string
+	conn := tls.Server(&helloConn{r: bytes.NewReader(hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errGotHello
+		},
+	})
+	conn.Handshake()
+	return name
+}
+
+// peekTLS returns the server name if the client started with a TLS handshake
+func peekTLS(br *bufio.Reader) (string, bool) {
+	header, err := br.Peek(5)
+	// a handshake record of TLS 1.0 or later
+	if err != nil || header[0] != 0x16 || header[1] != 3 {
+		return "", false
+	}
+	size := int(header[3])<<8 | int(header[4])
+	if 5+size > transparentPeekSize {
+		return "", true
+	}
+	record, err := br.Peek(5 + size)
+	if err != nil {
+		return "", true
+	}
+	return ServerNameFromHello(record), true
+}
+
+// peekHTTP returns the Host header if the client started with an HTTP request
+func peekHTTP(br *bufio.Reader) (string, bool) {
+	first, err := br.Peek(1)
+	if err != nil || first[0] < 'A' || first[0] > 'Z' {
+		return "", false
+	}
+	for {
+		buffered, _ := br.Peek(br.Buffered())
+		if end := bytes.Index(buffered, []byte("\r\n\r\n")); end >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buffered[:end+4])))
+			if err != nil {
+				return "", false
+			}
+			return req.Host, true
+		}
+		if br.Buffered() >= transparentPeekSize {
+			return "", false
+		}
+		// wait for more of the headers
+		if _, err := br.Peek(br.Buffered() + 1); err != nil {
+			return "", false
+		}
+	}
+}
+
+// transparentTarget works out where a redirected connection was going, the
+// name from the SNI or Host header is used with the original port so the PAC
+// can choose a route, otherwise the original address is used
+func transparentTarget(br *bufio.Reader, original string) (scheme string, host string) {
+	_, port, _ := net.SplitHostPort(original)
+	name, ok := peekTLS(br)
+	scheme = "https"
+	if !ok {
+		name, ok = peekHTTP(br)
+		scheme = "http"
+	}
+	if !ok {
+		return "tcp", original
+	}
+	if name == "" {
+		return scheme, original
+	}
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	return scheme, net.JoinHostPort(strings.Trim(name, "[]"), port)
+}
+
+// ServeTransparent accepts connections which were redirected to l with
+// iptables or nftables and tunnels them to where they were going
+func (p *proxy) ServeTransparent(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveTransparentConn(conn)
+	}
+}
+
+func (p *proxy) serveTransparentConn(conn net.Conn) {
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !p.acl.Allowed(net.ParseIP(clientIP)) {
+		log.Printf(`ServeTransparent: refusing connection from %v`, conn.RemoteAddr())
+		clientDenied.Inc()
+		conn.Close()
+		return
+	}
+	original, err := originalDestination(conn)
+	if err != nil {
+		log.Printf(`ServeTransparent: could not find the original destination of %v: %v`, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	// the local address is used rather than the listen address as that may be
+	// a wildcard like 0.0.0.0 when the original destination is a real address
+	if original == conn.LocalAddr().String() {
+		log.Printf(`ServeTransparent: %v connected to the transparent listener without being redirected`, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	totalRequests.Inc()
+
+	br := bufio.NewReaderSize(conn, transparentPeekSize)
+	conn.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	scheme, host := transparentTarget(br, original)
+	conn.SetReadDeadline(time.Time{})
+	transparentConnections.WithLabelValues(scheme).Inc()
+	log.Printf(`ServeTransparent: %v from %v to %v, original destination %v`, scheme, conn.RemoteAddr(), host, original)
+
+	rec := &accessRecord{
+		Time:   time.Now(),
+		Client: clientIP,
+		User:   "-",
+		Method: "TRANSPARENT",
+		Target: host,
+		Proto:  scheme,
+	}
+	lookupScheme := scheme
+	if lookupScheme == "tcp" {
+		// the PAC only knows about URLs
+		lookupScheme = "https"
+	}
+	if allowed, rule := p.policy.Check(lookupScheme, host); !allowed {
+		log.Printf(`ServeTransparent: %v blocked by policy %v`, host, rule)
+		destinationsBlocked.WithLabelValues(rule).Inc()
+		rec.Status = http.StatusForbidden
+		p.accessLog.Write(rec)
+		conn.Close()
+		return
+	}
+
+	target := url.URL{Scheme: lookupScheme, Host: host}
+	if _, port, _ := net.SplitHostPort(host); port == strconv.Itoa(defaultPort(lookupScheme)) {
+		target.Host = strings.TrimSuffix(host, ":"+port)
+	}
+	dest_conn, used, err := p.DialRoutes(p.Routes(target, rec), host)
+	if err != nil {
+		log.Printf(`ServeTransparent: could not connect to %v: %v`, host, err)
+		rec.Status = http.StatusBadGateway
+		p.accessLog.Write(rec)
+		conn.Close()
+		return
+	}
+	rec.Route = used.String()
+	rec.Status = http.StatusOK
+	proxyServeTimeHistogram.WithLabelValues(rec.Route).Observe(time.Since(rec.Time).Seconds())
+	p.conns.Tunnel(&peekedConn{conn, br}, dest_conn, tunnelOptions{
+		Name:     fmt.Sprintf("transparent %v to %v via %v", conn.RemoteAddr(), host, used),
+		Timeouts: p.tunnelTimeouts(used),
+		Flow:     p.throttle.Flow(clientIP, rec.User, host),
+		OnClose:  p.tunnelClosed(rec, &loggingWriter{}),
+	})
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// OriginalDestination returns the address a connection redirected by
+// netfilter was going to before it was redirected
+func OriginalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	var address string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// the sockaddr_in6 is returned in the same space as an ip6_mtuinfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			address = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port[0])<<8|int(port[1])))
+			return
+		}
+		// the sockaddr_in is returned in the same space as an ipv6_mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		sa := mreq.Multiaddr
+		address = net.JoinHostPort(net.IPv4(sa[4], sa[5], sa[6], sa[7]).String(), strconv.Itoa(int(sa[2])<<8|int(sa[3])))
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+	return address, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDestination needs SO_ORIGINAL_DST which only Linux has
+func OriginalDestination(conn net.Conn) (string, error) {
+	return "", errors.New("transparent proxy mode is only supported on Linux")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first record a TLS client sends for serverName
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	buf := make([]byte, transparentPeekSize)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("Error reading ClientHello: %v", err)
+	}
+	client.Close()
+	return buf[:n]
+}
+
+func TestTransparentTarget(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		scheme string
+		host   string
+	}{
+		{clientHello(t, "www.example.com"), "https", "www.example.com:8443"},
+		{[]byte("GET /path HTTP/1.1\r\nHost: api.example.com:8080\r\nUser-Agent: test\r\n\r\n"), "http", "api.example.com:8443"},
+		{[]byte("SSH-2.0-OpenSSH_8.9\r\n"), "tcp", "10.0.0.1:8443"},
+	}
+	for _, test := range tests {
+		br := bufio.NewReaderSize(bytes.NewReader(test.data), transparentPeekSize)
+		scheme, host := transparentTarget(br, "10.0.0.1:8443")
+		if scheme != test.scheme || host != test.host {
+			t.Fatalf("Got %v %v, want %v %v", scheme, host, test.scheme, test.host)
+		}
+		// everything peeked is still there to be sent on
+		if rest, _ := io.ReadAll(br); !bytes.Equal(rest, test.data) {
+			t.Fatalf("Expected the peeked data to be kept")
+		}
+	}
+}
+
+func TestServeTransparent(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from " + r.Host))
+	}))
+	defer target.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	var notRedirected int32
+	originalDestination = func(conn net.Conn) (string, error) {
+		if atomic.LoadInt32(&notRedirected) == 1 {
+			return conn.LocalAddr().String(), nil
+		}
+		return target.Listener.Addr().String(), nil
+	}
+	defer func() { originalDestination = OriginalDestination }()
+
+	var buf bytes.Buffer
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	p.accessLog = &accessLog{w: &buf, format: "json"}
+	go p.ServeTransparent(l)
+
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	conn.Close()
+	if string(body) != "hello from localhost" {
+		t.Fatalf("Got unexpected body %v", string(body))
+	}
+	r := waitForRecords(t, p.accessLog, &buf, 1)[0]
+	if r.Method != "TRANSPARENT" || r.Target != "localhost:"+port || r.Proto != "http" || r.Route != "DIRECT" || r.Status != 200 {
+		t.Fatalf("Got unexpected record %+v", r)
+	}
+
+	// connections which weren't redirected are closed straight away
+	atomic.StoreInt32(&notRedirected, 1)
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Expected the connection to be closed, got %v, %v", n, err)
+	}
+}
+
+func TestServeTransparentWildcardNotRedirected(t *testing.T) {
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	originalDestination = func(conn net.Conn) (string, error) {
+		return conn.LocalAddr().String(), nil
+	}
+	defer func() { originalDestination = OriginalDestination }()
+
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	go p.ServeTransparent(l)
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Expected the connection to be closed rather than proxied to itself, got %v, %v", n, err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// transportSettings controls the connection pools kept for each route
+type transportSettings struct {
+	MaxIdleConns            int
+	MaxIdleConnsPerUpstream int
+	MaxConnsPerUpstream     int
+	IdleConnTimeout         time.Duration
+}
+
+var defaultTransportSettings = transportSettings{
+	MaxIdleConns:            100,
+	MaxIdleConnsPerUpstream: 10,
+	MaxConnsPerUpstream:     0,
+	IdleConnTimeout:         90 * time.Second,
+}
+
+// upstreamRootCAs are trusted for TLS connections to destinations, nil means the system roots
+var upstreamRootCAs *x509.CertPool
+
+// upstreamLimiter caps the number of connections open to one upstream proxy
+// a nil limiter does not limit anything
+type upstreamLimiter struct {
+	slots chan struct{}
+	// closeIdle closes the pooled connections which aren't being used
+	closeIdle func()
+}
+
+func NewUpstreamLimiter(max int, closeIdle func()) *upstreamLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &upstreamLimiter{slots: make(chan struct{}, max), closeIdle: closeIdle}
+}
+
+// Dial waits for a free slot and then calls dial, the slot is given back when the connection is closed
+// idle pooled connections hold slots too so they are closed before waiting
+func (l *upstreamLimiter) Dial(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	if l == nil {
+		return dial()
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if l.closeIdle != nil {
+			l.closeIdle()
+		}
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	conn, err := dial()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, limiter: l}, nil
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter *upstreamLimiter
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		<-c.limiter.slots
+	})
+	return err
+}
+
+// NewRouteTransport builds a round tripper which sends plain HTTP requests via the route
+func NewRouteTransport(r route, settings transportSettings) http.RoundTripper {
+	transport := &http.Transport{
+		MaxIdleConns:        settings.MaxIdleConns,
+		MaxIdleConnsPerHost: settings.MaxIdleConnsPerUpstream,
+		IdleConnTimeout:     settings.IdleConnTimeout,
+		TLSClientConfig:     &tls.Config{RootCAs: upstreamRootCAs},
+	}
+	if r.IsDirect() {
+		transport.DialContext = global_resolver.DialContext
+		return transport
+	}
+
+	limiter := NewUpstreamLimiter(settings.MaxConnsPerUpstream, transport.CloseIdleConnections)
+	dialUpstream := func(ctx context.Context) (net.Conn, error) {
+		return limiter.Dial(ctx, func() (net.Conn, error) {
+			return DialUpstream(r)
+		})
+	}
+	dialRoute := func(ctx context.Context, addr string) (net.Conn, error) {
+		return limiter.Dial(ctx, func() (net.Conn, error) {
+			return DialRoute(r, addr)
+		})
+	}
+
+	if r.IsSocks() {
+		transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return dialRoute(ctx, addr)
+		}
+		return transport
+	}
+
+	// http:// requests are sent to the proxy as they are, https:// requests are
+	// tunnelled with ConnectUpstream so they get the same authentication handling
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if req.URL.Scheme == "https" {
+			return nil, nil
+		}
+		return r.ProxyURL(), nil
+	}
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return dialUpstream(ctx)
+	}
+	transport.DialTLSContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if addr == r.Address {
+			// this is the connection to an HTTPS proxy itself
+			return dialUpstream(ctx)
+		}
+		conn, err := dialRoute(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, RootCAs: upstreamRootCAs})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	if auth := GetUpstreamAuth(r.Address); auth != nil {
+		return &proxyAuthTransport{transport, r, auth, dialUpstream}
+	}
+	return transport
+}
+
+// transportPool keeps one long lived transport per route so connections are reused
+type transportPool struct {
+	settings   transportSettings
+	mu         sync.Mutex
+	transports map[string]http.RoundTripper
+}
+
+func NewTransportPool(settings transportSettings) *transportPool {
+	return &transportPool{settings: settings, transports: map[string]http.RoundTripper{}}
+}
+
+func (t *transportPool) Get(r route) http.RoundTripper {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	transport, ok := t.transports[r.String()]
+	if !ok {
+		log.Printf(`transportPool: creating transport for %v`, r)
+		transport = NewRouteTransport(r, t.settings)
+		t.transports[r.String()] = transport
+	}
+	return transport
+}
+
+// Reset drops all the transports, requests which are in flight carry on using
+// the old ones but their idle connections are closed
+func (t *transportPool) Reset() {
+	t.mu.Lock()
+	old := t.transports
+	t.transports = map[string]http.RoundTripper{}
+	t.mu.Unlock()
+	log.Printf(`transportPool: resetting %v transports`, len(old))
+	for _, transport := range old {
+		if c, ok := transport.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
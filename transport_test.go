@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamLimiterWaitsForClose(t *testing.T) {
+	l := NewUpstreamLimiter(1, nil)
+	dial := func() (net.Conn, error) {
+		a, _ := net.Pipe()
+		return a, nil
+	}
+	first, err := l.Dial(context.Background(), dial)
+	if err != nil {
+		t.Fatalf("Error calling Dial: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.Dial(ctx, dial); err == nil {
+		t.Fatalf("Expected the second Dial to wait for a free slot")
+	}
+	first.Close()
+	// closing twice must not give back two slots
+	first.Close()
+	second, err := l.Dial(context.Background(), dial)
+	if err != nil {
+		t.Fatalf("Error calling Dial after close: %v", err)
+	}
+	second.Close()
+}
+
+func TestTransportPoolReusesConnections(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	pool := NewTransportPool(defaultTransportSettings)
+	for i := 0; i < 3; i++ {
+		client := &http.Client{Transport: pool.Get(directRoute)}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Error calling Get: %v", err)
+		}
+		// the connection only goes back to the pool once the body has been read
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if atomic.LoadInt32(&conns) != 1 {
+		t.Fatalf("Got %v connections, expected 1", conns)
+	}
+	pool.Reset()
+	if pool.Get(directRoute) == nil || len(pool.transports) != 1 {
+		t.Fatalf("Expected a new transport after Reset")
+	}
+}
+
+func TestRouteTransportLimitSequential(t *testing.T) {
+	var targets []string
+	for i := 0; i < 2; i++ {
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		defer target.Close()
+		targets = append(targets, target.URL)
+	}
+	// each destination gets its own pooled connection through a SOCKS upstream
+	addr := startSocksServer(t, NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings))
+	settings := defaultTransportSettings
+	settings.MaxConnsPerUpstream = 1
+	transport := NewRouteTransport(route{Type: "SOCKS5", Address: addr}, settings)
+	for _, target := range append(targets, targets...) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			cancel()
+			t.Fatalf("Error sending request to %v: %v", target, err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+	}
+}
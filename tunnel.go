@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// reasons a tunnel was closed
+const (
+	closeIdle     = "idle"
+	closeLifetime = "lifetime"
+	closeEOF      = "eof"
+	closeError    = "error"
+	closeShutdown = "shutdown"
+)
+
+var tunnelsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_tunnels_closed",
+	Help: "Total tunnels closed by the reason they were closed",
+}, []string{"reason"})
+
+// duration reads "90s" style strings (or a number of seconds) from JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = duration(seconds * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New(`durations must be a string like "5m" or a number of seconds`)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// tunnelTimeouts limits how long a tunnel stays open, zero means no limit
+// Route is a route like "PROXY proxy.corp:8080" or just its type, e.g. "DIRECT"
+type tunnelTimeouts struct {
+	Route       string   `json:"route"`
+	Idle        duration `json:"idle"`
+	MaxLifetime duration `json:"max_lifetime"`
+}
+
+// TunnelTimeoutsFor finds the timeouts for r, an entry for the whole route wins
+// over one for its type and defaults is used when nothing matches
+func (c *config) TunnelTimeoutsFor(r route, defaults tunnelTimeouts) tunnelTimeouts {
+	var found *tunnelTimeouts
+	for i, t := range c.Tunnels {
+		if strings.EqualFold(t.Route, r.String()) {
+			return c.Tunnels[i]
+		}
+		if found == nil && strings.EqualFold(t.Route, r.Type) {
+			found = &c.Tunnels[i]
+		}
+	}
+	if found != nil {
+		return *found
+	}
+	return defaults
+}
+
+// tunnel copies data both ways between two connections, it is closed when
+// both sides have finished, nothing has been sent for the idle timeout or it
+// reaches its maximum lifetime
+type tunnel struct {
+	x, y    io.ReadWriteCloser
+	options tunnelOptions
+	start   time.Time
+	// last is when data last went either way, in unix nanoseconds
+	last      int64
+	closeOnce sync.Once
+	reason    string
+	done      chan struct{}
+}
+
+// tunnelOptions say how a tunnel is run
+type tunnelOptions struct {
+	Name     string
+	Timeouts tunnelTimeouts
+	// Flow limits and measures the bandwidth, nil means no limits, the
+	// tunnel calls Done on it when it closes
+	Flow *flow
+	// OnClose is called with the bytes sent from x to y and from y to x once the tunnel has closed
+	OnClose func(sent int64, received int64, reason string)
+}
+
+func NewTunnel(x io.ReadWriteCloser, y io.ReadWriteCloser, options tunnelOptions) *tunnel {
+	now := time.Now()
+	return &tunnel{x: x, y: y, options: options, start: now, last: now.UnixNano(), done: make(chan struct{})}
+}
+
+// CloseWithReason closes both sides, only the first reason is kept
+func (t *tunnel) CloseWithReason(reason string) {
+	t.closeOnce.Do(func() {
+		t.reason = reason
+		t.x.Close()
+		t.y.Close()
+		close(t.done)
+	})
+}
+
+func (t *tunnel) Close() error {
+	t.CloseWithReason(closeShutdown)
+	return nil
+}
+
+// activityWriter notes the time of every write so the tunnel knows it is not idle
+type activityWriter struct {
+	w io.Writer
+	t *tunnel
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&a.t.last, time.Now().UnixNano())
+	return a.w.Write(p)
+}
+
+// watch enforces the timeouts until the tunnel is closed
+func (t *tunnel) watch() {
+	var idle, lifetime <-chan time.Time
+	var idleTimer *time.Timer
+	if t.options.Timeouts.Idle > 0 {
+		idleTimer = time.NewTimer(time.Duration(t.options.Timeouts.Idle))
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if t.options.Timeouts.MaxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(time.Duration(t.options.Timeouts.MaxLifetime))
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-lifetime:
+			t.CloseWithReason(closeLifetime)
+			return
+		case <-idle:
+			quiet := time.Since(time.Unix(0, atomic.LoadInt64(&t.last)))
+			if quiet >= time.Duration(t.options.Timeouts.Idle) {
+				t.CloseWithReason(closeIdle)
+				return
+			}
+			idleTimer.Reset(time.Duration(t.options.Timeouts.Idle) - quiet)
+		}
+	}
+}
+
+// Run copies data until the tunnel closes and then logs why it closed
+func (t *tunnel) Run() {
+	go t.watch()
+	var wg sync.WaitGroup
+	var up, down int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		up = transfer(t, t.y, t.x)
+	}()
+	go func() {
+		defer wg.Done()
+		down = transfer(t, t.x, t.y)
+	}()
+	wg.Wait()
+	// both directions have finished
+	t.CloseWithReason(closeEOF)
+	t.options.Flow.Done()
+	tunnelsClosed.WithLabelValues(t.reason).Inc()
+	log.Printf(`tunnel: %v closed after %v, reason = %v, sent = %v, received = %v`, t.options.Name, time.Since(t.start).Round(time.Millisecond), t.reason, up, down)
+	if t.options.OnClose != nil {
+		t.options.OnClose(up, down, t.reason)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// runTestTunnel joins two pipes with a tunnel and returns the outside ends
+func runTestTunnel(timeouts tunnelTimeouts) (net.Conn, net.Conn, *tunnel, chan struct{}) {
+	a, b := net.Pipe()
+	c, d := net.Pipe()
+	t := NewTunnel(b, c, tunnelOptions{Name: "test", Timeouts: timeouts})
+	finished := make(chan struct{})
+	go func() {
+		t.Run()
+		close(finished)
+	}()
+	return a, d, t, finished
+}
+
+func waitForTunnel(t *testing.T, finished chan struct{}) {
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Tunnel did not close")
+	}
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	a, d, tun, finished := runTestTunnel(tunnelTimeouts{Idle: duration(100 * time.Millisecond)})
+	defer a.Close()
+	defer d.Close()
+	// keep it busy for longer than the idle timeout
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := d.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := a.Write([]byte("x")); err != nil {
+			t.Fatalf("Tunnel closed while it was still busy: %v", err)
+		}
+	}
+	waitForTunnel(t, finished)
+	if tun.reason != closeIdle {
+		t.Fatalf("Got close reason %v, expected %v", tun.reason, closeIdle)
+	}
+}
+
+func TestTunnelMaxLifetime(t *testing.T) {
+	a, d, tun, finished := runTestTunnel(tunnelTimeouts{MaxLifetime: duration(50 * time.Millisecond)})
+	defer a.Close()
+	defer d.Close()
+	waitForTunnel(t, finished)
+	if tun.reason != closeLifetime {
+		t.Fatalf("Got close reason %v, expected %v", tun.reason, closeLifetime)
+	}
+}
+
+func TestTunnelPeerEOF(t *testing.T) {
+	a, d, tun, finished := runTestTunnel(tunnelTimeouts{})
+	defer d.Close()
+	a.Close()
+	waitForTunnel(t, finished)
+	if tun.reason != closeEOF {
+		t.Fatalf("Got close reason %v, expected %v", tun.reason, closeEOF)
+	}
+}
+
+func TestTunnelTimeoutsFor(t *testing.T) {
+	c := &config{}
+	if err := json.Unmarshal([]byte(`{"tunnels": [
+		{"route": "PROXY", "idle": "10m"},
+		{"route": "PROXY special:8080", "idle": 30, "max_lifetime": "1h"}
+	]}`), c); err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	defaults := tunnelTimeouts{Idle: duration(time.Minute)}
+	if got := c.TunnelTimeoutsFor(route{Type: "PROXY", Address: "special:8080"}, defaults); got.Idle != duration(30*time.Second) || got.MaxLifetime != duration(time.Hour) {
+		t.Fatalf("Got unexpected timeouts for special = %+v", got)
+	}
+	if got := c.TunnelTimeoutsFor(route{Type: "PROXY", Address: "other:8080"}, defaults); got.Idle != duration(10*time.Minute) {
+		t.Fatalf("Got unexpected timeouts for other = %+v", got)
+	}
+	if got := c.TunnelTimeoutsFor(directRoute, defaults); got != defaults {
+		t.Fatalf("Got unexpected timeouts for DIRECT = %+v", got)
+	}
+}
+
+// tcpPair returns both ends of a TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	dialled, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialling: %v", err)
+	}
+	return dialled, <-accepted
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+	defer client.Close()
+	defer upstream.Close()
+	tun := NewTunnel(clientSide, upstreamSide, tunnelOptions{Name: "test"})
+	finished := make(chan struct{})
+	go func() {
+		tun.Run()
+		close(finished)
+	}()
+
+	// the upstream only answers once it has seen the end of the request
+	go func() {
+		request, _ := io.ReadAll(upstream)
+		upstream.Write([]byte("got " + string(request)))
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Error reading reply: %v", err)
+	}
+	if string(reply) != "got request" {
+		t.Fatalf("Got unexpected reply = %v", string(reply))
+	}
+	waitForTunnel(t, finished)
+	if tun.reason != closeEOF {
+		t.Fatalf("Got close reason %v, expected %v", tun.reason, closeEOF)
+	}
+}
+
+func TestServeTunnelKeepsEarlyData(t *testing.T) {
+	// the destination echoes one line back
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		io.WriteString(conn, line)
+	}()
+
+	p := NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to proxy: %v", err)
+	}
+	defer conn.Close()
+	addr := target.Addr().String()
+	// the data is sent without waiting for the 200
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\nhello\n", addr, addr)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from CONNECT, got %v (%v)", resp, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := br.ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("Expected the early data to be echoed, got %q (%v)", line, err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// wsSchemes maps WebSocket schemes onto the HTTP schemes used to look them up in
+// the PAC file and to send them, this is what browsers do
+var wsSchemes = map[string]string{
+	"ws":  "http",
+	"wss": "https",
+}
+
+// HttpURL returns u with a ws or wss scheme swapped for http or https
+func HttpURL(u url.URL) url.URL {
+	if scheme, ok := wsSchemes[strings.ToLower(u.Scheme)]; ok {
+		u.Scheme = scheme
+	}
+	return u
+}
+
+// headerHasToken checks for a token in a comma separated header like Connection
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUpgradeRequest is true when the client is asking to switch protocols e.g. to a WebSocket
+func IsUpgradeRequest(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && headerHasToken(req.Header, "Connection", "upgrade")
+}
+
+// upgradedBody is the connection to the upstream once it has switched protocols
+type upgradedBody struct {
+	br   *bufio.Reader
+	conn net.Conn
+}
+
+func (u *upgradedBody) Read(p []byte) (int, error) {
+	return u.br.Read(p)
+}
+
+func (u *upgradedBody) Write(p []byte) (int, error) {
+	return u.conn.Write(p)
+}
+
+func (u *upgradedBody) CloseWrite() error {
+	if cw, ok := u.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection cannot be half closed")
+}
+
+func (u *upgradedBody) Close() error {
+	return u.conn.Close()
+}
+
+// halfCloser lets either half of an upgraded connection be half closed, the
+// body http.Transport gives back for a 101 can't be so it is closed instead and
+// the reads which then fail are treated as the end of the data
+type halfCloser struct {
+	io.ReadWriteCloser
+	closed int32
+}
+
+func (h *halfCloser) CloseWrite() error {
+	if cw, ok := h.ReadWriteCloser.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return nil
+	}
+	atomic.StoreInt32(&h.closed, 1)
+	return h.ReadWriteCloser.Close()
+}
+
+func (h *halfCloser) Read(p []byte) (int, error) {
+	n, err := h.ReadWriteCloser.Read(p)
+	if err != nil && atomic.LoadInt32(&h.closed) == 1 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// serveUpgrade sends a 101 response on to the client and takes over both
+// connections so they can be joined into a tunnel
+func serveUpgrade(wr http.ResponseWriter, resp *http.Response) (io.ReadWriteCloser, io.ReadWriteCloser, bool) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf(`serveUpgrade: upstream connection cannot be written to`)
+		resp.Body.Close()
+		http.Error(wr, "Upgrade failed", http.StatusBadGateway)
+		return nil, nil, false
+	}
+	hijacker, ok := wr.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(wr, "Hijacking not supported", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	client_conn, client_buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf(`serveUpgrade: error hijacking connection: %v`, err)
+		upstream.Close()
+		return nil, nil, false
+	}
+
+	// Connection and Upgrade have to go back to the client, the other hop headers don't
+	for _, h := range []string{"Keep-Alive", "Proxy-Authenticate", "Proxy-Connection", "Te", "Trailers", "Transfer-Encoding"} {
+		resp.Header.Del(h)
+	}
+	if _, err := io.WriteString(client_buf, "HTTP/1.1 "+resp.Status+"\r\n"); err == nil {
+		resp.Header.Write(client_buf)
+		io.WriteString(client_buf, "\r\n")
+	}
+	if err := client_buf.Flush(); err != nil {
+		log.Printf(`serveUpgrade: error writing response to client: %v`, err)
+		client_conn.Close()
+		upstream.Close()
+		return nil, nil, false
+	}
+	// anything the client sent straight after the request is already in the buffer
+	if n := client_buf.Reader.Buffered(); n > 0 {
+		early, _ := client_buf.Reader.Peek(n)
+		if _, err := upstream.Write(early); err != nil {
+			client_conn.Close()
+			upstream.Close()
+			return nil, nil, false
+		}
+	}
+	log.Printf(`serveUpgrade: switched protocols to %v`, resp.Header.Get("Upgrade"))
+	return &halfCloser{ReadWriteCloser: client_conn}, &halfCloser{ReadWriteCloser: upstream}, true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEchoUpgradeServer switches to an echo protocol when asked to
+func startEchoUpgradeServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsUpgradeRequest(r) || r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "expected an upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func checkUpgrade(t *testing.T, proxyAddr string, target string) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Error connecting to proxy: %v", err)
+	}
+	defer conn.Close()
+	u, _ := url.Parse(target)
+	// the first message is sent straight after the request to check early data is kept
+	fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello", target, u.Host)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Got status %v, upgrade %v, expected 101 to echo", resp.Status, resp.Header.Get("Upgrade"))
+	}
+	conn.Write([]byte(" world"))
+	reply := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(br, reply); err != nil {
+		t.Fatalf("Error reading echo: %v", err)
+	}
+	if string(reply) != "hello world" {
+		t.Fatalf("Got unexpected echo = %v", string(reply))
+	}
+}
+
+func TestServeHTTPUpgradeDirect(t *testing.T) {
+	echo := startEchoUpgradeServer(t)
+	p := httptest.NewServer(NewProxy("", "127.0.0.1", nil, false, defaultTransportSettings))
+	defer p.Close()
+	checkUpgrade(t, strings.TrimPrefix(p.URL, "http://"), strings.Replace(echo.URL, "http://", "ws://", 1)+"/socket")
+}
+
+func TestServeHTTPUpgradeViaUpstream(t *testing.T) {
+	// the echo server takes absolute URIs so it can stand in for the upstream proxy
+	echo := startEchoUpgradeServer(t)
+	upstream := strings.TrimPrefix(echo.URL, "http://")
+	pac := fmt.Sprintf(`function FindProxyForURL(url, host) {
+		if (url.substring(0, 5) == "http:") {
+			return "PROXY %v";
+		}
+		return "DIRECT";
+	}`, upstream)
+	p := httptest.NewServer(NewProxy(pac, "127.0.0.1", nil, true, defaultTransportSettings))
+	defer p.Close()
+	checkUpgrade(t, strings.TrimPrefix(p.URL, "http://"), "ws://websocket.example.com/socket")
+}
+
+func TestHalfCloserHalfClosesTCP(t *testing.T) {
+	conn, peer := tcpPair(t)
+	defer peer.Close()
+	h := &halfCloser{ReadWriteCloser: conn}
+	defer h.Close()
+	if err := h.CloseWrite(); err != nil {
+		t.Fatalf("Error half closing: %v", err)
+	}
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(peer); err != nil {
+		t.Fatalf("Error reading to the end: %v", err)
+	}
+	// the other direction still works
+	peer.Write([]byte("reply"))
+	peer.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(h)
+	if err != nil || string(reply) != "reply" {
+		t.Fatalf("Got reply %v, error %v, expected reply", string(reply), err)
+	}
+}
+
+func TestHalfCloserFallsBackToClose(t *testing.T) {
+	// pipes can't be half closed, like the body http.Transport returns for a 101
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	h := &halfCloser{ReadWriteCloser: conn}
+	if err := h.CloseWrite(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Got error %v from the peer, expected EOF", err)
+	}
+	if _, err := h.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Got error %v after closing, expected EOF", err)
+	}
+}
+
+func TestHttpURL(t *testing.T) {
+	u, _ := url.Parse("wss://example.com/socket")
+	if got := HttpURL(*u); got.String() != "https://example.com/socket" {
+		t.Fatalf("Got unexpected URL = %v", got.String())
+	}
+}